@@ -12,4 +12,6 @@ func main() {
 			return smartos.Provider()
 		},
 	})
+
+	smartos.CloseClients()
 }
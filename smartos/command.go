@@ -0,0 +1,28 @@
+package smartos
+
+import (
+	"regexp"
+	"strings"
+)
+
+// safeShellArgument matches arguments that a POSIX shell passes through unchanged.
+var safeShellArgument = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// shellQuote quotes an argument so that a POSIX shell passes it to the command verbatim.
+func shellQuote(arg string) string {
+	if safeShellArgument.MatchString(arg) {
+		return arg
+	}
+
+	return "'" + strings.Replace(arg, "'", `'"'"'`, -1) + "'"
+}
+
+// shellCommand builds a command line for a POSIX shell from an argument vector.
+func shellCommand(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,246 @@
+package smartos
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ConnectionPool keeps a single SSH connection per node and is safe for concurrent use.  Dead
+// connections are detected with keepalives and replaced on the next use.
+type ConnectionPool struct {
+	hosts             map[string]*Host
+	hostKeyVerifier   *HostKeyVerifier
+	keepaliveInterval time.Duration
+
+	lock    sync.Mutex
+	entries map[string]*poolEntry
+	closed  bool
+}
+
+type poolEntry struct {
+	lock       sync.Mutex
+	connection *sshConnection
+	done       chan struct{}
+
+	// dialing is held while connecting so that only one connection is made at a time, and
+	// waiting for it can be given up when the context is done.
+	dialing semaphore
+}
+
+func NewConnectionPool(hosts map[string]*Host, hostKeyVerifier *HostKeyVerifier, keepaliveInterval time.Duration) *ConnectionPool {
+	return &ConnectionPool{
+		hosts:             hosts,
+		hostKeyVerifier:   hostKeyVerifier,
+		keepaliveInterval: keepaliveInterval,
+		entries:           make(map[string]*poolEntry),
+	}
+}
+
+// Get returns a live connection to the node, connecting or reconnecting as needed.  Connecting
+// is given up when the context is done.
+func (p *ConnectionPool) Get(ctx context.Context, nodeName string) (*sshConnection, error) {
+	host, ok := p.hosts[nodeName]
+	if !ok {
+		return nil, fmt.Errorf("unknown node %s; it must be configured in the provider's hosts", nodeName)
+	}
+
+	p.lock.Lock()
+	if p.closed {
+		p.lock.Unlock()
+		return nil, fmt.Errorf("connection pool has been closed")
+	}
+
+	entry, ok := p.entries[nodeName]
+	if !ok {
+		entry = &poolEntry{dialing: newSemaphore(1)}
+		p.entries[nodeName] = entry
+	}
+	p.lock.Unlock()
+
+	// Only the entry is held while dialing so that slow nodes do not hold up the others.
+	if err := entry.dialing.Acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer entry.dialing.Release()
+
+	entry.lock.Lock()
+	if entry.connection != nil {
+		select {
+		case <-entry.done:
+			log.Printf("SSH: Connection to %s was lost, reconnecting", nodeName)
+			entry.connection = nil
+		default:
+			connection := entry.connection
+			entry.lock.Unlock()
+			return connection, nil
+		}
+	}
+	entry.lock.Unlock()
+
+	connection, err := dialHost(ctx, host, p.hostKeyVerifier)
+	if err != nil {
+		log.Printf("SSH: Connection to %s failed: %s", nodeName, err)
+		return nil, err
+	}
+
+	p.lock.Lock()
+	closed := p.closed
+	p.lock.Unlock()
+
+	if closed {
+		connection.Close()
+		return nil, fmt.Errorf("connection pool has been closed")
+	}
+
+	log.Printf("SSH: Connected to %s successfully", nodeName)
+
+	done := make(chan struct{})
+	entry.lock.Lock()
+	entry.connection = connection
+	entry.done = done
+	entry.lock.Unlock()
+
+	go func() {
+		connection.Wait()
+		close(done)
+	}()
+
+	if p.keepaliveInterval > 0 {
+		go p.keepalive(nodeName, connection, done)
+	}
+
+	return connection, nil
+}
+
+// NewSession opens a session on the node.  A cached connection that turns out to be broken
+// is discarded and the session is retried once on a fresh connection.
+func (p *ConnectionPool) NewSession(ctx context.Context, nodeName string) (*ssh.Session, error) {
+	connection, err := p.Get(ctx, nodeName)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := newSession(ctx, connection)
+	if err == nil || ctx.Err() != nil {
+		return session, err
+	}
+
+	log.Printf("SSH: Failed to open session on %s (%s), reconnecting", nodeName, err)
+	p.Invalidate(nodeName, connection)
+
+	connection, err = p.Get(ctx, nodeName)
+	if err != nil {
+		return nil, err
+	}
+
+	return newSession(ctx, connection)
+}
+
+// newSession opens a session on the connection, giving up waiting when the context is done.
+// The connection is shared with the other commands on the node, so it is left open and the
+// session is closed once it opens; a connection that stopped answering is dropped by the
+// keepalives.
+func newSession(ctx context.Context, connection *sshConnection) (*ssh.Session, error) {
+	type result struct {
+		session *ssh.Session
+		err     error
+	}
+
+	opened := make(chan result, 1)
+	go func() {
+		session, err := connection.NewSession()
+		opened <- result{session, err}
+	}()
+
+	select {
+	case r := <-opened:
+		return r.session, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-opened; r.session != nil {
+				r.session.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// Invalidate closes the connection and removes it from the pool if it is still the current
+// connection for the node.
+func (p *ConnectionPool) Invalidate(nodeName string, connection *sshConnection) {
+	p.lock.Lock()
+	entry, ok := p.entries[nodeName]
+	p.lock.Unlock()
+
+	if !ok {
+		return
+	}
+
+	entry.lock.Lock()
+	if entry.connection == connection {
+		entry.connection = nil
+	}
+	entry.lock.Unlock()
+
+	connection.Close()
+}
+
+// Close closes every pooled connection.  The pool cannot be used afterwards.
+func (p *ConnectionPool) Close() {
+	p.lock.Lock()
+	p.closed = true
+	entries := p.entries
+	p.entries = make(map[string]*poolEntry)
+	p.lock.Unlock()
+
+	for nodeName, entry := range entries {
+		entry.lock.Lock()
+		if entry.connection != nil {
+			log.Printf("SSH: Closing connection to %s", nodeName)
+			entry.connection.Close()
+			entry.connection = nil
+		}
+		entry.lock.Unlock()
+	}
+}
+
+func (p *ConnectionPool) keepalive(nodeName string, connection *sshConnection, done chan struct{}) {
+	ticker := time.NewTicker(p.keepaliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		// A request on a dead TCP connection can block for a long time, so give up once
+		// the next keepalive is due.
+		result := make(chan error, 1)
+		go func() {
+			_, _, err := connection.SendRequest("keepalive@openssh.com", true, nil)
+			result <- err
+		}()
+
+		var err error
+		select {
+		case err = <-result:
+		case <-done:
+			return
+		case <-time.After(p.keepaliveInterval):
+			err = fmt.Errorf("no reply within %s", p.keepaliveInterval)
+		}
+
+		if err != nil {
+			log.Printf("SSH: Keepalive to %s failed (%s), dropping connection", nodeName, err)
+			p.Invalidate(nodeName, connection)
+			return
+		}
+	}
+}
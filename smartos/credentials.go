@@ -0,0 +1,187 @@
+package smartos
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Credentials holds the secrets used to authenticate with a SmartOS global zone.
+//
+// Authentication methods are offered to the server in the following order:
+//  1. public keys: the OpenSSH certificate (if any), private_key, private_key_file
+//     and finally the keys held by the SSH agent
+//  2. password
+//  3. keyboard-interactive, answering every prompt with the password
+type Credentials struct {
+	PrivateKey           string
+	PrivateKeyFile       string
+	PrivateKeyPassphrase string
+	Password             string
+	Certificate          string
+	CertificateFile      string
+}
+
+// AuthMethods builds the SSH authentication methods for the credentials.  agentSigners may
+// be nil when no SSH agent is available.
+func (c *Credentials) AuthMethods(agentSigners func() ([]ssh.Signer, error)) ([]ssh.AuthMethod, error) {
+	signers, err := c.Signers()
+	if err != nil {
+		return nil, err
+	}
+
+	authMethods := []ssh.AuthMethod{}
+
+	// The SSH client only tries each authentication method type once, so all public keys
+	// must be offered through a single callback.
+	if len(signers) > 0 || agentSigners != nil {
+		authMethods = append(authMethods, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			allSigners := append([]ssh.Signer{}, signers...)
+
+			if agentSigners != nil {
+				agentKeys, err := agentSigners()
+				if err != nil {
+					log.Printf("SSH: Failed to retrieve keys from agent: %s", err)
+				} else {
+					allSigners = append(allSigners, agentKeys...)
+				}
+			}
+
+			return allSigners, nil
+		}))
+	}
+
+	if c.Password != "" {
+		password := c.Password
+		authMethods = append(authMethods, ssh.Password(password))
+		authMethods = append(authMethods, ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			answers := make([]string, len(questions))
+			for i := range answers {
+				answers[i] = password
+			}
+			return answers, nil
+		}))
+	}
+
+	if len(authMethods) == 0 {
+		return nil, fmt.Errorf("no SSH authentication method available; set private_key, private_key_file or password, or start an SSH agent")
+	}
+
+	return authMethods, nil
+}
+
+// Signers returns the signers for the configured private keys, with the certificate signer
+// (if any) first.
+func (c *Credentials) Signers() ([]ssh.Signer, error) {
+	var keys [][]byte
+
+	if c.PrivateKey != "" {
+		keys = append(keys, []byte(c.PrivateKey))
+	}
+
+	if c.PrivateKeyFile != "" {
+		key, err := readFile(c.PrivateKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read private key file %s: %s", c.PrivateKeyFile, err)
+		}
+		keys = append(keys, key)
+	}
+
+	var signers []ssh.Signer
+	for _, key := range keys {
+		signer, err := c.parsePrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, signer)
+	}
+
+	certificate := []byte(c.Certificate)
+	if c.CertificateFile != "" {
+		var err error
+		certificate, err = readFile(c.CertificateFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read certificate file %s: %s", c.CertificateFile, err)
+		}
+	}
+
+	if len(certificate) == 0 {
+		return signers, nil
+	}
+
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey(certificate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate: %s", err)
+	}
+
+	cert, ok := publicKey.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("certificate is a plain public key rather than an OpenSSH certificate")
+	}
+
+	for _, signer := range signers {
+		if bytes.Equal(signer.PublicKey().Marshal(), cert.Key.Marshal()) {
+			certSigner, err := ssh.NewCertSigner(cert, signer)
+			if err != nil {
+				return nil, err
+			}
+
+			return append([]ssh.Signer{certSigner}, signers...), nil
+		}
+	}
+
+	return nil, fmt.Errorf("certificate does not match private_key or private_key_file")
+}
+
+func (c *Credentials) parsePrivateKey(key []byte) (ssh.Signer, error) {
+	if c.PrivateKeyPassphrase != "" {
+		signer, err := ssh.ParsePrivateKeyWithPassphrase(key, []byte(c.PrivateKeyPassphrase))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse private key: %s", err)
+		}
+		return signer, nil
+	}
+
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		if _, ok := err.(*ssh.PassphraseMissingError); ok {
+			return nil, fmt.Errorf("private key is encrypted; set private_key_passphrase")
+		}
+		return nil, fmt.Errorf("failed to parse private key: %s", err)
+	}
+
+	return signer, nil
+}
+
+// connectAgent connects to the SSH agent named by SSH_AUTH_SOCK.  It returns a nil
+// connection when no agent is available.
+func connectAgent() (net.Conn, agent.ExtendedAgent) {
+	sshSocket := os.Getenv("SSH_AUTH_SOCK")
+	if sshSocket == "" {
+		log.Println("SSH: SSH_AUTH_SOCK is not set, not using an SSH agent")
+		return nil, nil
+	}
+
+	agentConnection, err := net.Dial("unix", sshSocket)
+	if err != nil {
+		log.Printf("SSH: Failed to connect to SSH agent at %s: %s", sshSocket, err)
+		return nil, nil
+	}
+
+	return agentConnection, agent.NewClient(agentConnection)
+}
+
+func readFile(path string) ([]byte, error) {
+	expandedPath, err := expandPath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.ReadFile(expandedPath)
+}
@@ -0,0 +1,164 @@
+package smartos
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testPrivateKey returns a new RSA private key in PEM format, encrypted when passphrase is set.
+func testPrivateKey(t *testing.T, passphrase string) (string, ssh.PublicKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	if passphrase != "" {
+		block, err = x509.EncryptPEMBlock(rand.Reader, block.Type, block.Bytes, []byte(passphrase), x509.PEMCipherAES256)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	publicKey, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(pem.EncodeToMemory(block)), publicKey
+}
+
+// testCertificate returns an OpenSSH user certificate for the key in authorized_keys format.
+func testCertificate(t *testing.T, key ssh.PublicKey) string {
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca, err := ssh.NewSignerFromKey(caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert := &ssh.Certificate{
+		Key:             key,
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"root"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+
+	if err := cert.SignCert(rand.Reader, ca); err != nil {
+		t.Fatal(err)
+	}
+
+	return string(ssh.MarshalAuthorizedKey(cert))
+}
+
+func TestCredentialsSigners(t *testing.T) {
+	key, publicKey := testPrivateKey(t, "")
+	otherKey, _ := testPrivateKey(t, "")
+	encryptedKey, encryptedPublicKey := testPrivateKey(t, "hunter2")
+	certificate := testCertificate(t, publicKey)
+
+	dir, err := ioutil.TempDir("", "credentials")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certificateFile := filepath.Join(dir, "id_rsa-cert.pub")
+	if err := ioutil.WriteFile(certificateFile, []byte(certificate), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name        string
+		credentials Credentials
+		err         string
+		signers     []ssh.PublicKey
+		certificate bool
+	}{
+		{
+			name:        "private key",
+			credentials: Credentials{PrivateKey: key},
+			signers:     []ssh.PublicKey{publicKey},
+		},
+		{
+			name:        "encrypted private key",
+			credentials: Credentials{PrivateKey: encryptedKey, PrivateKeyPassphrase: "hunter2"},
+			signers:     []ssh.PublicKey{encryptedPublicKey},
+		},
+		{
+			name:        "missing passphrase",
+			credentials: Credentials{PrivateKey: encryptedKey},
+			err:         "private key is encrypted; set private_key_passphrase",
+		},
+		{
+			name:        "wrong passphrase",
+			credentials: Credentials{PrivateKey: encryptedKey, PrivateKeyPassphrase: "hunter3"},
+			err:         "failed to parse private key",
+		},
+		{
+			name:        "certificate of another key",
+			credentials: Credentials{PrivateKey: otherKey, Certificate: certificate},
+			err:         "certificate does not match private_key or private_key_file",
+		},
+		{
+			// The certificate is offered before the key it certifies.
+			name:        "certificate file",
+			credentials: Credentials{PrivateKey: key, CertificateFile: certificateFile},
+			signers:     []ssh.PublicKey{publicKey, publicKey},
+			certificate: true,
+		},
+		{
+			name:        "plain public key as certificate",
+			credentials: Credentials{PrivateKey: key, Certificate: string(ssh.MarshalAuthorizedKey(publicKey))},
+			err:         "certificate is a plain public key",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			signers, err := tc.credentials.Signers()
+
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("error = %v, want one containing %q", err, tc.err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if len(signers) != len(tc.signers) {
+				t.Fatalf("%d signers, want %d", len(signers), len(tc.signers))
+			}
+
+			for i, signer := range signers {
+				signerKey := signer.PublicKey()
+				if cert, ok := signerKey.(*ssh.Certificate); ok {
+					if i != 0 || !tc.certificate {
+						t.Errorf("signer %d is an unexpected certificate", i)
+					}
+					signerKey = cert.Key
+				} else if i == 0 && tc.certificate {
+					t.Errorf("signer 0 is not the certificate")
+				}
+
+				if string(signerKey.Marshal()) != string(tc.signers[i].Marshal()) {
+					t.Errorf("signer %d has the wrong key", i)
+				}
+			}
+		})
+	}
+}
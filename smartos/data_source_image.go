@@ -1,24 +1,37 @@
 package smartos
 
 import (
-	"fmt"
+	"context"
 	"log"
+	"regexp"
+	"time"
 
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
 )
 
+// imageFieldPattern matches valid image names and versions.  It also keeps imgadm from
+// treating a value as a substring (~) filter.
+var imageFieldPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._+-]*$`)
+
 func datasourceImage() *schema.Resource {
 	return &schema.Resource{
 		SchemaVersion: 1,
-		Read:          datasourceImageReadRunc,
+		ReadContext:   datasourceImageReadRunc,
+		Timeouts: &schema.ResourceTimeout{
+			Read: schema.DefaultTimeout(5 * time.Minute),
+		},
 		Schema: map[string]*schema.Schema{
 			"name": {
-				Type:     schema.TypeString,
-				Required: true,
+				Type:         schema.TypeString,
+				Required:     true,
+				ValidateFunc: validation.StringMatch(imageFieldPattern, "must only contain letters, digits, '.', '_', '+' and '-'"),
 			},
 			"version": {
-				Type:     schema.TypeString,
-				Required: true,
+				Type:         schema.TypeString,
+				Required:     true,
+				ValidateFunc: validation.StringMatch(imageFieldPattern, "must only contain letters, digits, '.', '_', '+' and '-'"),
 			},
 			"node_name": {
 				Type:     schema.TypeString,
@@ -28,7 +41,7 @@ func datasourceImage() *schema.Resource {
 	}
 }
 
-func datasourceImageReadRunc(d *schema.ResourceData, m interface{}) error {
+func datasourceImageReadRunc(ctx context.Context, d *schema.ResourceData, m interface{}) diag.Diagnostics {
 	client := m.(*SmartOSClient)
 
 	name := d.Get("name").(string)
@@ -38,21 +51,21 @@ func datasourceImageReadRunc(d *schema.ResourceData, m interface{}) error {
 	var image *Image
 	var err error
 
-	image, err = client.GetLocalImage(nodeName, name, version)
+	image, err = client.GetLocalImage(ctx, nodeName, name, version)
 	if err != nil {
-		return err
+		return diag.FromErr(err)
 	}
 
 	if image == nil {
-		image, err = client.FindRemoteImage(nodeName, name, version)
+		image, err = client.FindRemoteImage(ctx, nodeName, name, version)
 		if err == nil && image == nil {
-			return fmt.Errorf("Image not found")
+			return diag.Errorf("Image not found")
 		}
 	}
 
 	if err != nil {
 		log.Printf("Failed to retrieve image with name: %s, version: %s.  Error: %s", name, version, err)
-		return err
+		return diag.FromErr(err)
 	}
 
 	d.SetId(image.ID.String())
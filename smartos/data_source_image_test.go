@@ -0,0 +1,101 @@
+package smartos
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/resource"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+func testAccImageConfig(f *fakeSmartOS, name string, version string) string {
+	return f.ProviderConfig() + fmt.Sprintf(`
+data "smartos_image" "test" {
+  node_name = "node1"
+  name      = %q
+  version   = %q
+}
+`, name, version)
+}
+
+func TestAccImage_basic(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+	f.AddAvailableImage(testImage)
+
+	resource.Test(t, resource.TestCase{
+		ProviderFactories: testProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: testAccImageConfig(f, testImage.Name, testImage.Version),
+				Check:  resource.TestCheckResourceAttr("data.smartos_image.test", "id", testImage.UUID),
+			},
+		},
+	})
+}
+
+func TestAccImage_notFound(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+
+	resource.Test(t, resource.TestCase{
+		ProviderFactories: testProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				Config:      testAccImageConfig(f, testImage.Name, testImage.Version),
+				ExpectError: regexp.MustCompile("Image not found"),
+			},
+		},
+	})
+}
+
+func TestAccImage_timeout(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+	f.AddInstalledImage(testImage)
+
+	resource.Test(t, resource.TestCase{
+		ProviderFactories: testProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				PreConfig: func() {
+					f.FailSlowly("imgadm list", 0, 1)
+				},
+				Config: testAccImageConfig(f, testImage.Name, testImage.Version),
+				Check:  resource.TestCheckResourceAttr("data.smartos_image.test", "id", testImage.UUID),
+			},
+		},
+	})
+}
+
+func TestDataSourceImage_read(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+	f.AddInstalledImage(testImage)
+	f.AddAvailableImage(fakeImage{UUID: "0ab1d3b6-2a3c-11ea-bd05-1b54e1d8c3b2", Name: "base-64-lts", Version: "19.3.0"})
+
+	client := testClient(t, f, nil)
+	defer client.Close()
+	ctx := context.Background()
+
+	for version, want := range map[string]string{
+		"19.4.0": testImage.UUID,
+		"19.3.0": "0ab1d3b6-2a3c-11ea-bd05-1b54e1d8c3b2",
+	} {
+		d := schema.TestResourceDataRaw(t, datasourceImage().Schema, map[string]interface{}{
+			"node_name": "node1",
+			"name":      "base-64-lts",
+			"version":   version,
+		})
+
+		if diags := datasourceImageReadRunc(ctx, d, client); diags.HasError() {
+			t.Fatal(diags)
+		}
+
+		if d.Id() != want {
+			t.Errorf("image %s: ID = %s, want %s", version, d.Id(), want)
+		}
+	}
+}
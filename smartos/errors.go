@@ -0,0 +1,163 @@
+package smartos
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SessionError is returned when no SSH session could be opened on a node.  No remote command
+// was started, so the operation can be retried unless the node rejected the connection with a
+// *ConnectRejectedError.
+type SessionError struct {
+	NodeName string
+	Err      error
+}
+
+func (e *SessionError) Error() string {
+	return fmt.Sprintf("failed to open SSH session on node %s: %s", e.NodeName, e.Err)
+}
+
+func (e *SessionError) Unwrap() error {
+	return e.Err
+}
+
+// ConnectRejectedError is returned when a node, or a bastion in front of it, was reached but
+// its host key failed verification or it rejected every authentication method.  Retrying
+// cannot fix either.
+type ConnectRejectedError struct {
+	NodeName string
+	Err      error
+}
+
+func (e *ConnectRejectedError) Error() string {
+	return fmt.Sprintf("SSH connection to %s rejected: %s", e.NodeName, e.Err)
+}
+
+func (e *ConnectRejectedError) Unwrap() error {
+	return e.Err
+}
+
+// x/crypto/ssh reports a rejected exec request and failed authentication only in the text of
+// its errors.  Whether vmadm create is retried depends on both, so TestSSHErrorWording pins
+// the wording of the vendored version.
+
+// isExecRejected reports whether Session.Start failed because the server rejected the exec
+// request, so that the command did not start.  When the request or its reply was lost, the
+// command may be running.
+func isExecRejected(err error, command string) bool {
+	return err.Error() == fmt.Sprintf("ssh: command %v failed", command)
+}
+
+// isAuthenticationRejected reports whether an SSH handshake failed because the server rejected
+// every authentication method.
+func isAuthenticationRejected(err error) bool {
+	return strings.Contains(err.Error(), "ssh: unable to authenticate")
+}
+
+// CommandError is returned when a remote command fails or its connection is lost while it
+// runs.
+type CommandError struct {
+	Command string
+	Err     error
+	Stderr  string
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("remote command %s failed.  Error: %s (%s)", e.Command, e.Err, strings.TrimSpace(e.Stderr))
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// Kinds of vmadm failures.  Use errors.Is to test a *VmadmError for them.
+var (
+	ErrNotFound        = errors.New("not found")
+	ErrAlreadyExists   = errors.New("already exists")
+	ErrInvalidProperty = errors.New("invalid property")
+	ErrBusy            = errors.New("machine busy")
+)
+
+var (
+	vmadmNotFoundPattern        = regexp.MustCompile(`(?i)(no such zone configured|does not exist|unable to find|vm .*not found)`)
+	vmadmAlreadyExistsPattern   = regexp.MustCompile(`(?i)already exists`)
+	vmadmInvalidPropertyPattern = regexp.MustCompile(`(?i)(invalid value\(s\) for: *([^\n]*)|invalid propert|unknown propert|invalid json)`)
+)
+
+// VmadmError is a vmadm command that ran and failed, classified by what it printed on stderr.
+// fwadm reports errors the same way, so its failures are classified too.
+type VmadmError struct {
+	Kind    error
+	Command string
+	Message string
+
+	// Properties names the rejected properties of an ErrInvalidProperty error, when vmadm
+	// lists them.
+	Properties []string
+
+	Err *CommandError
+}
+
+func (e *VmadmError) Error() string {
+	return fmt.Sprintf("%s failed: %s", e.Command, e.Message)
+}
+
+func (e *VmadmError) Is(target error) bool {
+	return target == e.Kind
+}
+
+func (e *VmadmError) Unwrap() error {
+	return e.Err
+}
+
+// classifyVmadmError turns the *CommandError of a vmadm command that exited with an error
+// into a *VmadmError when its message is recognized.  Other errors are returned unchanged.
+func classifyVmadmError(err error) error {
+	var commandError *CommandError
+	if !errors.As(err, &commandError) || !commandExited(commandError) {
+		return err
+	}
+
+	stderr := commandError.Stderr
+	vmadmError := &VmadmError{Command: commandError.Command, Message: lastLine(stderr), Err: commandError}
+
+	switch {
+	case vmadmNotFoundPattern.MatchString(stderr):
+		vmadmError.Kind = ErrNotFound
+	case vmadmAlreadyExistsPattern.MatchString(stderr):
+		vmadmError.Kind = ErrAlreadyExists
+	case vmadmInvalidPropertyPattern.MatchString(stderr):
+		vmadmError.Kind = ErrInvalidProperty
+		if properties := vmadmInvalidPropertyPattern.FindStringSubmatch(stderr)[2]; properties != "" {
+			for _, property := range strings.Split(properties, ",") {
+				vmadmError.Properties = append(vmadmError.Properties, strings.TrimSpace(property))
+			}
+		}
+	case transientCommandErrors.MatchString(stderr):
+		vmadmError.Kind = ErrBusy
+	default:
+		return err
+	}
+
+	return vmadmError
+}
+
+// commandExited reports whether the command ran to completion with an exit status, as opposed
+// to losing its connection.
+func commandExited(commandError *CommandError) bool {
+	var exitError *ssh.ExitError
+	var localExitError *exec.ExitError
+	return errors.As(commandError.Err, &exitError) || errors.As(commandError.Err, &localExitError)
+}
+
+// lastLine returns the last non-empty line of output, where vmadm prints the reason it
+// failed.
+func lastLine(output string) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
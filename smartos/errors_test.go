@@ -0,0 +1,124 @@
+package smartos
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestClassifyVmadmError(t *testing.T) {
+	for _, tc := range []struct {
+		stderr     string
+		kind       error
+		properties []string
+	}{
+		{stderr: "Failed to get VM 2d6d1f0a-5b39-4b5b-a2a4-1b9c3c2d1e0f: No such zone configured\n", kind: ErrNotFound},
+		{stderr: "Failed to delete VM: VM 2d6d1f0a-5b39-4b5b-a2a4-1b9c3c2d1e0f does not exist\n", kind: ErrNotFound},
+		{stderr: "Failed to create VM: VM with uuid 2d6d1f0a-5b39-4b5b-a2a4-1b9c3c2d1e0f already exists\n", kind: ErrAlreadyExists},
+		{stderr: "Failed to update VM: Invalid value(s) for: brand, ram\n", kind: ErrInvalidProperty, properties: []string{"brand", "ram"}},
+		{stderr: "Failed to create VM: Invalid JSON payload: unexpected end of input\n", kind: ErrInvalidProperty},
+		{stderr: "Failed to update VM: failed to acquire lock\n", kind: ErrBusy},
+		{stderr: "Failed to stop VM: zone is busy\n", kind: ErrBusy},
+		{stderr: "something unexpected\n"},
+	} {
+		commandError := &CommandError{Command: "vmadm get", Err: &ssh.ExitError{}, Stderr: tc.stderr}
+
+		err := classifyVmadmError(commandError)
+
+		var vmadmError *VmadmError
+		if tc.kind == nil {
+			if errors.As(err, &vmadmError) {
+				t.Errorf("%q: classified as %s, want unclassified", tc.stderr, vmadmError.Kind)
+			}
+			continue
+		}
+
+		if !errors.Is(err, tc.kind) {
+			t.Errorf("%q: got %v, want %s", tc.stderr, err, tc.kind)
+			continue
+		}
+
+		errors.As(err, &vmadmError)
+		if !reflect.DeepEqual(vmadmError.Properties, tc.properties) {
+			t.Errorf("%q: properties = %q, want %q", tc.stderr, vmadmError.Properties, tc.properties)
+		}
+
+		if !errors.Is(err, commandError) {
+			t.Errorf("%q: does not wrap the command error", tc.stderr)
+		}
+	}
+}
+
+func TestClassifyVmadmError_lostConnection(t *testing.T) {
+	commandError := &CommandError{Command: "vmadm get", Err: &ssh.ExitMissingError{}, Stderr: "No such zone configured"}
+
+	if err := classifyVmadmError(commandError); err != commandError {
+		t.Errorf("a command that did not exit was classified: %v", err)
+	}
+}
+
+// TestSSHErrorWording checks the error text isExecRejected and isAuthenticationRejected rely on
+// against the vendored x/crypto/ssh.
+func TestSSHErrorWording(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+
+	dial := func(password string, hostKeyCallback ssh.HostKeyCallback) (*ssh.Client, error) {
+		return ssh.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", f.Port()), &ssh.ClientConfig{
+			User:            "root",
+			Auth:            []ssh.AuthMethod{ssh.Password(password)},
+			HostKeyCallback: hostKeyCallback,
+		})
+	}
+
+	t.Run("authentication", func(t *testing.T) {
+		_, err := dial("wrong", ssh.InsecureIgnoreHostKey())
+		if err == nil || !isAuthenticationRejected(err) {
+			t.Errorf("isAuthenticationRejected(%v) = false for a wrong password", err)
+		}
+
+		rejectHostKey := func(string, net.Addr, ssh.PublicKey) error { return errors.New("host key rejected") }
+		if _, err := dial(f.password, rejectHostKey); err == nil || isAuthenticationRejected(err) {
+			t.Errorf("isAuthenticationRejected(%v) = true for a rejected host key", err)
+		}
+	})
+
+	client, err := dial(f.password, ssh.InsecureIgnoreHostKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	for _, tc := range []struct {
+		name     string
+		kind     fakeFailureKind
+		rejected bool
+	}{
+		{name: "exec rejected", kind: fakeFailRejectExec, rejected: true},
+		{name: "exec dropped", kind: fakeFailDropExec, rejected: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f.Fail("vmadm list", tc.kind, "", 1)
+
+			session, err := client.NewSession()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer session.Close()
+
+			command := shellCommand([]string{"vmadm", "list"})
+			err = session.Start(command)
+			if err == nil {
+				t.Fatal("expected Start to fail")
+			}
+
+			if isExecRejected(err, command) != tc.rejected {
+				t.Errorf("isExecRejected(%v) = %t, want %t", err, !tc.rejected, tc.rejected)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package smartos
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os/exec"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Executor runs commands in the global zone of a SmartOS node.
+type Executor interface {
+	// Run runs the command given as an argument vector, feeding it stdin when it is not nil,
+	// and returns what the command wrote to stdout and stderr.  Failures are reported as
+	// *SessionError when the command could not be started remotely and *CommandError
+	// otherwise.  The command is killed when the context is done before it finishes.
+	Run(ctx context.Context, args []string, stdin []byte) ([]byte, []byte, error)
+}
+
+// sshExecutor runs commands over SSH using the connection pool.
+type sshExecutor struct {
+	host *Host
+	pool *ConnectionPool
+}
+
+func (e *sshExecutor) Run(ctx context.Context, args []string, stdin []byte) ([]byte, []byte, error) {
+	// The SSH server hands the command line to the user's shell, so every argument is quoted.
+	command := shellCommand(args)
+
+	if !e.host.sessions.TryAcquire() {
+		log.Printf("Waiting for a free SSH session on node %s", e.host.Name)
+		if err := e.host.sessions.Acquire(ctx); err != nil {
+			return nil, nil, &CommandError{Command: command, Err: err}
+		}
+	}
+
+	defer e.host.sessions.Release()
+
+	session, err := e.pool.NewSession(ctx, e.host.Name)
+	if err != nil {
+		return nil, nil, &SessionError{NodeName: e.host.Name, Err: err}
+	}
+
+	defer session.Close()
+
+	var stdout bytes.Buffer
+	session.Stdout = &stdout
+
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+
+	if stdin != nil {
+		session.Stdin = bytes.NewReader(stdin)
+	}
+
+	log.Printf("SSH execute on %s: %s", e.host.Name, command)
+	err = session.Start(command)
+	if err != nil {
+		// Only a rejected exec request means that the command did not start.
+		if isExecRejected(err, command) {
+			return nil, nil, &SessionError{NodeName: e.host.Name, Err: err}
+		}
+
+		return nil, nil, &CommandError{Command: command, Err: err}
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Wait()
+	}()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		log.Printf("SSH killing %s on %s: %s", command, e.host.Name, ctx.Err())
+		session.Signal(ssh.SIGKILL)
+		session.Close()
+		<-done
+		err = ctx.Err()
+	}
+
+	if err != nil {
+		return stdout.Bytes(), stderr.Bytes(), &CommandError{Command: command, Err: err, Stderr: stderr.String()}
+	}
+
+	return stdout.Bytes(), stderr.Bytes(), nil
+}
+
+// localExecutor runs commands on the machine the provider runs on, for use when the
+// provider itself runs in a global zone.
+type localExecutor struct {
+	nodeName string
+}
+
+func (e *localExecutor) Run(ctx context.Context, args []string, stdin []byte) ([]byte, []byte, error) {
+	command := shellCommand(args)
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+
+	log.Printf("Local execute on %s: %s", e.nodeName, command)
+	err := cmd.Run()
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+
+	if err != nil {
+		return stdout.Bytes(), stderr.Bytes(), &CommandError{Command: command, Err: err, Stderr: stderr.String()}
+	}
+
+	return stdout.Bytes(), stderr.Bytes(), nil
+}
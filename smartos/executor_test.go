@@ -0,0 +1,168 @@
+package smartos
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeExecutor answers commands with canned results, one per call, and records the commands.
+type fakeExecutor struct {
+	results []fakeExecutorResult
+	calls   [][]string
+	stdins  [][]byte
+}
+
+type fakeExecutorResult struct {
+	stdout string
+	stderr string
+	err    error
+}
+
+func (e *fakeExecutor) Run(ctx context.Context, args []string, stdin []byte) ([]byte, []byte, error) {
+	e.calls = append(e.calls, args)
+	e.stdins = append(e.stdins, stdin)
+
+	if len(e.results) == 0 {
+		return nil, nil, errors.New("no more results")
+	}
+
+	result := e.results[0]
+	e.results = e.results[1:]
+	return []byte(result.stdout), []byte(result.stderr), result.err
+}
+
+func testFakeClient(executor Executor) *SmartOSClient {
+	return &SmartOSClient{
+		executors:   map[string]Executor{"node1": executor},
+		retryPolicy: &RetryPolicy{MaxRetries: 2},
+	}
+}
+
+func TestClient_run(t *testing.T) {
+	const id = "2d6d1f0a-5b39-4b5b-a2a4-1b9c3c2d1e0f"
+
+	lostSession := &SessionError{NodeName: "node1", Err: io.EOF}
+	lostCommand := &CommandError{Command: "vmadm create", Err: io.EOF}
+	notFound := &CommandError{Command: "vmadm get", Err: &ssh.ExitError{}, Stderr: "Failed to get VM: No such zone configured\n"}
+
+	t.Run("output", func(t *testing.T) {
+		executor := &fakeExecutor{results: []fakeExecutorResult{{stdout: `{"uuid": "` + id + `", "alias": "test"}`}}}
+
+		machine, err := testFakeClient(executor).GetMachine(context.Background(), "node1", uuid.MustParse(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if machine.Alias != "test" || machine.NodeName != "node1" {
+			t.Errorf("machine = %s on %s, want test on node1", machine.Alias, machine.NodeName)
+		}
+
+		if want := [][]string{{"vmadm", "get", id}}; !reflect.DeepEqual(executor.calls, want) {
+			t.Errorf("commands = %v, want %v", executor.calls, want)
+		}
+	})
+
+	t.Run("stdin", func(t *testing.T) {
+		executor := &fakeExecutor{results: []fakeExecutorResult{{}}}
+
+		if _, _, err := testFakeClient(executor).run(context.Background(), "node1", []string{"fwadm", "add"}, []byte("{}"), false); err != nil {
+			t.Fatal(err)
+		}
+
+		if string(executor.stdins[0]) != "{}" {
+			t.Errorf("stdin = %q, want {}", executor.stdins[0])
+		}
+	})
+
+	t.Run("retried", func(t *testing.T) {
+		executor := &fakeExecutor{results: []fakeExecutorResult{{err: lostSession}, {stdout: "ok"}}}
+
+		stdout, _, err := testFakeClient(executor).run(context.Background(), "node1", []string{"vmadm", "create"}, nil, false)
+		if err != nil || string(stdout) != "ok" || len(executor.calls) != 2 {
+			t.Errorf("stdout = %q, err = %v after %d calls, want ok after 2", stdout, err, len(executor.calls))
+		}
+	})
+
+	t.Run("not retried", func(t *testing.T) {
+		executor := &fakeExecutor{results: []fakeExecutorResult{{err: lostCommand}, {}}}
+
+		_, _, err := testFakeClient(executor).run(context.Background(), "node1", []string{"vmadm", "create"}, nil, false)
+		if err != lostCommand || len(executor.calls) != 1 {
+			t.Errorf("err = %v after %d calls, want the lost command after 1", err, len(executor.calls))
+		}
+	})
+
+	t.Run("classified", func(t *testing.T) {
+		executor := &fakeExecutor{results: []fakeExecutorResult{{err: notFound}}}
+
+		_, err := testFakeClient(executor).GetMachine(context.Background(), "node1", uuid.MustParse(id))
+		if !errors.Is(err, ErrNotFound) || len(executor.calls) != 1 {
+			t.Errorf("err = %v after %d calls, want ErrNotFound after 1", err, len(executor.calls))
+		}
+	})
+
+	t.Run("unknown node", func(t *testing.T) {
+		_, _, err := testFakeClient(&fakeExecutor{}).run(context.Background(), "node2", []string{"vmadm", "list"}, nil, true)
+		if err == nil || !strings.Contains(err.Error(), "unknown node node2") {
+			t.Errorf("err = %v, want unknown node", err)
+		}
+	})
+}
+
+func TestLocalExecutor(t *testing.T) {
+	executor := &localExecutor{nodeName: "node1"}
+
+	t.Run("output", func(t *testing.T) {
+		stdout, stderr, err := executor.Run(context.Background(), []string{"/bin/sh", "-c", "cat; echo failed >&2"}, []byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(stdout) != "hello" || string(stderr) != "failed\n" {
+			t.Errorf("stdout = %q, stderr = %q, want hello and failed", stdout, stderr)
+		}
+	})
+
+	t.Run("exit status", func(t *testing.T) {
+		_, _, err := executor.Run(context.Background(), []string{"/bin/sh", "-c", "echo 'No such zone configured' >&2; exit 1"}, nil)
+
+		var commandError *CommandError
+		if !errors.As(err, &commandError) || !commandExited(commandError) {
+			t.Fatalf("err = %#v, want a *CommandError with an exit status", err)
+		}
+
+		if !errors.Is(classifyVmadmError(err), ErrNotFound) {
+			t.Errorf("err = %v, want it classified as ErrNotFound", classifyVmadmError(err))
+		}
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		_, _, err := executor.Run(ctx, []string{"sleep", "60"}, nil)
+
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("err = %v, want context.DeadlineExceeded", err)
+		}
+
+		if elapsed := time.Since(start); elapsed > 10*time.Second {
+			t.Errorf("Run returned after %s, long after the context was done", elapsed)
+		}
+
+		var exitError *exec.ExitError
+		if errors.As(err, &exitError) {
+			t.Errorf("a killed command is reported with its exit status: %v", err)
+		}
+	})
+}
@@ -0,0 +1,1364 @@
+package smartos
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeFailureKind selects how an injected failure manifests itself.
+type fakeFailureKind int
+
+const (
+	// fakeFailExit makes the command exit with status 1 and the failure's stderr.
+	fakeFailExit fakeFailureKind = iota
+	// fakeFailDisconnect closes the session without an exit status after the failure's
+	// delay, like a connection that timed out or dropped while the command ran.
+	fakeFailDisconnect
+	// fakeFailBadJSON makes the command print malformed JSON.
+	fakeFailBadJSON
+	// fakeFailLoseExit runs the command but closes the session before its exit status, like
+	// a connection that dropped just as the command finished.
+	fakeFailLoseExit
+	// fakeFailRefuseSession rejects the session before any command runs.
+	fakeFailRefuseSession
+	// fakeFailRejectExec rejects the exec request, so the command never starts.
+	fakeFailRejectExec
+	// fakeFailDropExec closes the session after receiving the exec request but before
+	// replying to it, so the client cannot tell whether the command started.
+	fakeFailDropExec
+	// fakeFailHoldSession accepts the session only after the failure's delay.
+	fakeFailHoldSession
+)
+
+// fakeFailure makes the next matching commands fail.
+type fakeFailure struct {
+	prefix string
+	kind   fakeFailureKind
+	stderr string
+	delay  time.Duration
+	count  int
+}
+
+type fakeImage struct {
+	UUID    string
+	Name    string
+	Version string
+	OS      string
+}
+
+// fakeSmartOS emulates the vmadm and imgadm commands of a SmartOS global zone behind an
+// in-process SSH server.
+type fakeSmartOS struct {
+	t            *testing.T
+	listener     net.Listener
+	config       *ssh.ServerConfig
+	hostKey      ssh.Signer
+	clientKeyPEM string
+	password     string
+
+	lock            sync.Mutex
+	connections     []*ssh.ServerConn
+	machines        map[string]map[string]interface{}
+	installedImages map[string]fakeImage
+	firewallRules   map[string]map[string]interface{}
+	availableImages map[string]fakeImage
+	failures        []*fakeFailure
+	commands        [][]string
+	activeSessions  int
+	maxSessions     int
+	commandDelay    time.Duration
+	signals         []string
+	bootDelay       time.Duration
+	bootMetadata    map[string]string
+	nextMAC         int
+}
+
+func newFakeSmartOS(t *testing.T) *fakeSmartOS {
+	_, hostPrivateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hostKey, err := ssh.NewSignerFromKey(hostPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientPrivateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientKeyBytes, err := x509.MarshalECPrivateKey(clientPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientPublicKey, err := ssh.NewPublicKey(&clientPrivateKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fakeSmartOS{
+		t:               t,
+		hostKey:         hostKey,
+		clientKeyPEM:    string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: clientKeyBytes})),
+		password:        "secret",
+		machines:        map[string]map[string]interface{}{},
+		installedImages: map[string]fakeImage{},
+		firewallRules:   map[string]map[string]interface{}{},
+		availableImages: map[string]fakeImage{},
+	}
+
+	f.config = &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) == string(clientPublicKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown public key for %s", conn.User())
+		},
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if string(password) == f.password {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("wrong password for %s", conn.User())
+		},
+	}
+	f.config.AddHostKey(hostKey)
+
+	f.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go f.serve()
+
+	return f
+}
+
+func (f *fakeSmartOS) Close() {
+	f.listener.Close()
+	f.DropConnections()
+}
+
+func (f *fakeSmartOS) Port() int {
+	return f.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (f *fakeSmartOS) HostKeyFingerprint() string {
+	return ssh.FingerprintSHA256(f.hostKey.PublicKey())
+}
+
+// DropConnections closes every client connection from the server side.
+func (f *fakeSmartOS) DropConnections() {
+	f.lock.Lock()
+	connections := f.connections
+	f.connections = nil
+	f.lock.Unlock()
+
+	for _, conn := range connections {
+		conn.Close()
+	}
+}
+
+// ProviderConfig returns the HCL configuration of a provider talking to the fake as node1.
+func (f *fakeSmartOS) ProviderConfig() string {
+	return fmt.Sprintf(`
+provider "smartos" {
+  host {
+    name        = "node1"
+    address     = "127.0.0.1"
+    port        = %d
+    host_key    = %q
+    private_key = <<EOF
+%sEOF
+  }
+
+  retry_initial_backoff = 0
+  keepalive_interval    = 0
+}
+`, f.Port(), f.HostKeyFingerprint(), f.clientKeyPEM)
+}
+
+// ProviderRawConfig returns the provider configuration as a raw map for
+// terraform.NewResourceConfigRaw.
+func (f *fakeSmartOS) ProviderRawConfig() map[string]interface{} {
+	return map[string]interface{}{
+		"host": []interface{}{
+			map[string]interface{}{
+				"name":        "node1",
+				"address":     "127.0.0.1",
+				"port":        f.Port(),
+				"host_key":    f.HostKeyFingerprint(),
+				"private_key": f.clientKeyPEM,
+			},
+		},
+		"retry_initial_backoff": 0,
+		"keepalive_interval":    0,
+	}
+}
+
+func (f *fakeSmartOS) AddAvailableImage(image fakeImage) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.availableImages[image.UUID] = image
+}
+
+func (f *fakeSmartOS) AddInstalledImage(image fakeImage) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.installedImages[image.UUID] = image
+}
+
+// AddMachine stores a VM as if it had been created outside of Terraform.
+func (f *fakeSmartOS) AddMachine(vm map[string]interface{}) string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	id, ok := vm["uuid"].(string)
+	if !ok {
+		id = uuid.New().String()
+		vm["uuid"] = id
+	}
+
+	f.completeMachine(vm)
+	f.machines[id] = vm
+	return id
+}
+
+func (f *fakeSmartOS) Machine(id string) map[string]interface{} {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.machines[id]
+}
+
+func (f *fakeSmartOS) DeleteMachine(id string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	delete(f.machines, id)
+}
+
+// Fail injects a failure for the next count commands starting with prefix.
+func (f *fakeSmartOS) Fail(prefix string, kind fakeFailureKind, stderr string, count int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.failures = append(f.failures, &fakeFailure{prefix: prefix, kind: kind, stderr: stderr, count: count})
+}
+
+// FailSlowly makes the next count commands starting with prefix hang for delay and then drop
+// the session, like a command that timed out.
+func (f *fakeSmartOS) FailSlowly(prefix string, delay time.Duration, count int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.failures = append(f.failures, &fakeFailure{prefix: prefix, kind: fakeFailDisconnect, delay: delay, count: count})
+}
+
+// HoldSessions makes the next count sessions open only after delay, like a node that is slow
+// to answer.
+func (f *fakeSmartOS) HoldSessions(delay time.Duration, count int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.failures = append(f.failures, &fakeFailure{kind: fakeFailHoldSession, delay: delay, count: count})
+}
+
+// Commands returns the argument vectors of every command run so far.
+func (f *fakeSmartOS) Commands() [][]string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([][]string{}, f.commands...)
+}
+
+// CommandCount returns how many commands started with prefix.
+func (f *fakeSmartOS) CommandCount(prefix string) int {
+	count := 0
+	for _, args := range f.Commands() {
+		if strings.HasPrefix(strings.Join(args, " "), prefix) {
+			count++
+		}
+	}
+	return count
+}
+
+// Signals returns the names of the signals sent to commands so far.
+func (f *fakeSmartOS) Signals() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]string{}, f.signals...)
+}
+
+// SetCommandDelay makes every command take at least delay to run.
+func (f *fakeSmartOS) SetCommandDelay(delay time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.commandDelay = delay
+}
+
+// SimulateBoot makes machines created from now on provision for delay before they run, and
+// has their guests publish metadata once they do.
+func (f *fakeSmartOS) SimulateBoot(delay time.Duration, metadata map[string]string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.bootDelay = delay
+	f.bootMetadata = metadata
+}
+
+func (f *fakeSmartOS) MaxConcurrentSessions() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.maxSessions
+}
+
+func (f *fakeSmartOS) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go f.handleConnection(conn)
+	}
+}
+
+func (f *fakeSmartOS) handleConnection(conn net.Conn) {
+	serverConn, channels, requests, err := ssh.NewServerConn(conn, f.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	f.lock.Lock()
+	f.connections = append(f.connections, serverConn)
+	f.lock.Unlock()
+
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+
+		if f.takeFailure("", fakeFailRefuseSession) != nil {
+			newChannel.Reject(ssh.ResourceShortage, "too many sessions")
+			continue
+		}
+
+		if failure := f.takeFailure("", fakeFailHoldSession); failure != nil {
+			go func(newChannel ssh.NewChannel) {
+				time.Sleep(failure.delay)
+				if channel, channelRequests, err := newChannel.Accept(); err == nil {
+					f.handleSession(channel, channelRequests)
+				}
+			}(newChannel)
+			continue
+		}
+
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+
+		go f.handleSession(channel, channelRequests)
+	}
+}
+
+func (f *fakeSmartOS) handleSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+
+	f.lock.Lock()
+	f.activeSessions++
+	if f.activeSessions > f.maxSessions {
+		f.maxSessions = f.activeSessions
+	}
+	f.lock.Unlock()
+
+	defer func() {
+		f.lock.Lock()
+		f.activeSessions--
+		f.lock.Unlock()
+	}()
+
+	for request := range requests {
+		if request.Type != "exec" {
+			request.Reply(false, nil)
+			continue
+		}
+
+		var payload struct{ Command string }
+		if err := ssh.Unmarshal(request.Payload, &payload); err != nil {
+			request.Reply(false, nil)
+			return
+		}
+
+		if args, err := splitShellWords(payload.Command); err == nil {
+			if f.takeFailure(strings.Join(args, " "), fakeFailRejectExec) != nil {
+				request.Reply(false, nil)
+				continue
+			}
+
+			if f.takeFailure(strings.Join(args, " "), fakeFailDropExec) != nil {
+				f.lock.Lock()
+				f.commands = append(f.commands, args)
+				f.lock.Unlock()
+				return
+			}
+		}
+
+		request.Reply(true, nil)
+
+		// Signals and the closing of the session interrupt slow commands.
+		killed := make(chan struct{})
+		go func() {
+			for request := range requests {
+				if request.Type == "signal" {
+					var signal struct{ Signal string }
+					ssh.Unmarshal(request.Payload, &signal)
+					f.lock.Lock()
+					f.signals = append(f.signals, signal.Signal)
+					f.lock.Unlock()
+				}
+				if request.WantReply {
+					request.Reply(false, nil)
+				}
+			}
+			close(killed)
+		}()
+
+		stdin, _ := ioutil.ReadAll(channel)
+
+		args, err := splitShellWords(payload.Command)
+		if err != nil {
+			fmt.Fprintf(channel.Stderr(), "sh: %s\n", err)
+			f.sendExitStatus(channel, 2)
+			return
+		}
+
+		f.lock.Lock()
+		f.commands = append(f.commands, args)
+		delay := f.commandDelay
+		f.lock.Unlock()
+
+		select {
+		case <-time.After(delay):
+		case <-killed:
+			return
+		}
+
+		if failure := f.takeFailure(strings.Join(args, " "), -1); failure != nil {
+			switch failure.kind {
+			case fakeFailExit:
+				fmt.Fprint(channel.Stderr(), failure.stderr)
+				f.sendExitStatus(channel, 1)
+				return
+			case fakeFailDisconnect:
+				select {
+				case <-time.After(failure.delay):
+				case <-killed:
+				}
+				return
+			case fakeFailBadJSON:
+				fmt.Fprint(channel, "{\"uuid\": \"truncated")
+				f.sendExitStatus(channel, 0)
+				return
+			case fakeFailLoseExit:
+				f.execute(args, stdin)
+				return
+			}
+		}
+
+		stdout, stderr, status := f.execute(args, stdin)
+		io.WriteString(channel, stdout)
+		io.WriteString(channel.Stderr(), stderr)
+		f.sendExitStatus(channel, status)
+		return
+	}
+}
+
+func (f *fakeSmartOS) sendExitStatus(channel ssh.Channel, status uint32) {
+	channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+}
+
+// takeFailure returns and consumes the first injected failure matching the command and kind.
+// A negative kind matches the kinds that fail a command after it started.
+func (f *fakeSmartOS) takeFailure(command string, kind fakeFailureKind) *fakeFailure {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for i, failure := range f.failures {
+		if kind >= 0 && failure.kind != kind {
+			continue
+		}
+
+		if kind < 0 && failure.kind >= fakeFailRefuseSession {
+			continue
+		}
+
+		if !strings.HasPrefix(command, failure.prefix) {
+			continue
+		}
+
+		failure.count--
+		if failure.count <= 0 {
+			f.failures = append(f.failures[:i], f.failures[i+1:]...)
+		}
+
+		return failure
+	}
+
+	return nil
+}
+
+func (f *fakeSmartOS) execute(args []string, stdin []byte) (string, string, uint32) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if len(args) < 2 {
+		return "", fmt.Sprintf("sh: %s: command not found\n", strings.Join(args, " ")), 127
+	}
+
+	switch args[0] + " " + args[1] {
+	case "vmadm create":
+		return f.vmadmCreate(stdin)
+	case "vmadm get":
+		return f.vmadmGet(args[2:])
+	case "vmadm update":
+		return f.vmadmUpdate(args[2:], stdin)
+	case "vmadm delete":
+		return f.vmadmDelete(args[2:])
+	case "vmadm start":
+		return f.vmadmSetState(args[2:], "start", "running")
+	case "vmadm stop":
+		return f.vmadmSetState(args[2:], "stop", "stopped")
+	case "vmadm reboot":
+		return f.vmadmReboot(args[2:])
+	case "vmadm list":
+		return f.vmadmList(args[2:])
+	case "fwadm add":
+		return f.fwadmAdd(args[2:], stdin)
+	case "fwadm get":
+		return f.fwadmGet(args[2:])
+	case "fwadm update":
+		return f.fwadmUpdate(args[2:], stdin)
+	case "fwadm delete":
+		return f.fwadmDelete(args[2:])
+	case "imgadm list":
+		return f.imgadmList(f.installedImages, args[2:])
+	case "imgadm avail":
+		return f.imgadmList(f.availableImages, args[2:])
+	case "imgadm import":
+		return f.imgadmImport(args[2:])
+	}
+
+	return "", fmt.Sprintf("%s: unknown command %s\n", args[0], args[1]), 2
+}
+
+// fwadmKeywords are the rule keywords fwadm reports in upper case.
+var fwadmKeywords = map[string]bool{
+	"from": true, "to": true, "allow": true, "block": true, "port": true, "ports": true,
+	"type": true, "code": true, "and": true, "or": true,
+}
+
+// fwadmRules parses the rules payload fwadm add and update read with -f -.
+func fwadmRules(args []string, stdin []byte) ([]map[string]interface{}, string) {
+	if len(args) != 2 || args[0] != "-f" || args[1] != "-" {
+		return nil, "fwadm: error: expected -f -\n"
+	}
+
+	var payload struct {
+		Rules []map[string]interface{} `json:"rules"`
+	}
+	if err := json.Unmarshal(stdin, &payload); err != nil {
+		return nil, fmt.Sprintf("fwadm: error: Invalid JSON: %s\n", err)
+	}
+
+	for _, rule := range payload.Rules {
+		text, _ := rule["rule"].(string)
+		words := strings.Fields(text)
+		if len(words) == 0 || !strings.EqualFold(words[0], "from") {
+			return nil, fmt.Sprintf("fwadm: error: Error at character 0: '%s', expected: 'FROM'\n", text)
+		}
+
+		for i, word := range words {
+			if fwadmKeywords[strings.ToLower(word)] {
+				words[i] = strings.ToUpper(word)
+			}
+		}
+		rule["rule"] = strings.Join(words, " ")
+	}
+
+	return payload.Rules, ""
+}
+
+func (f *fakeSmartOS) fwadmAdd(args []string, stdin []byte) (string, string, uint32) {
+	rules, problem := fwadmRules(args, stdin)
+	if problem != "" {
+		return "", problem, 1
+	}
+
+	var output strings.Builder
+	output.WriteString("Added rules:\n")
+	for _, rule := range rules {
+		id, ok := rule["uuid"].(string)
+		if !ok {
+			id = uuid.New().String()
+			rule["uuid"] = id
+		}
+
+		if _, exists := f.firewallRules[id]; exists {
+			return "", fmt.Sprintf("fwadm: error: Rule %s already exists\n", id), 1
+		}
+
+		if _, ok := rule["enabled"]; !ok {
+			rule["enabled"] = false
+		}
+		rule["version"] = fmt.Sprintf("%d.000000", time.Now().Unix())
+
+		f.firewallRules[id] = rule
+		fmt.Fprintf(&output, "%s %s\n", id, rule["rule"])
+	}
+
+	return output.String(), "", 0
+}
+
+func (f *fakeSmartOS) fwadmGet(args []string) (string, string, uint32) {
+	if len(args) != 1 {
+		return "", "fwadm: error: Must specify rule UUID\n", 1
+	}
+
+	rule, ok := f.firewallRules[args[0]]
+	if !ok {
+		return "", fmt.Sprintf("fwadm: error: Rule \"%s\" does not exist\n", args[0]), 1
+	}
+
+	output, _ := json.MarshalIndent(rule, "", "  ")
+	return string(output) + "\n", "", 0
+}
+
+func (f *fakeSmartOS) fwadmUpdate(args []string, stdin []byte) (string, string, uint32) {
+	rules, problem := fwadmRules(args, stdin)
+	if problem != "" {
+		return "", problem, 1
+	}
+
+	var output strings.Builder
+	output.WriteString("Updated rules:\n")
+	for _, rule := range rules {
+		id, _ := rule["uuid"].(string)
+		existing, ok := f.firewallRules[id]
+		if !ok {
+			return "", fmt.Sprintf("fwadm: error: Rule \"%s\" does not exist\n", id), 1
+		}
+
+		for key, value := range rule {
+			existing[key] = value
+		}
+		if _, ok := rule["description"]; !ok {
+			delete(existing, "description")
+		}
+
+		fmt.Fprintf(&output, "%s %s\n", id, existing["rule"])
+	}
+
+	return output.String(), "", 0
+}
+
+func (f *fakeSmartOS) fwadmDelete(args []string) (string, string, uint32) {
+	if len(args) != 1 {
+		return "", "fwadm: error: Must specify rule UUID\n", 1
+	}
+
+	if _, ok := f.firewallRules[args[0]]; !ok {
+		return "", fmt.Sprintf("fwadm: error: Rule \"%s\" does not exist\n", args[0]), 1
+	}
+
+	delete(f.firewallRules, args[0])
+
+	return fmt.Sprintf("Deleted rules:\n%s\n", args[0]), "", 0
+}
+
+// FirewallRule returns the rule with the given UUID, or nil if it does not exist.
+func (f *fakeSmartOS) FirewallRule(id string) map[string]interface{} {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.firewallRules[id]
+}
+
+func (f *fakeSmartOS) vmadmCreate(stdin []byte) (string, string, uint32) {
+	var vm map[string]interface{}
+	if err := json.Unmarshal(stdin, &vm); err != nil {
+		return "", fmt.Sprintf("Failed to create VM: Invalid JSON payload: %s\n", err), 1
+	}
+
+	brand, _ := vm["brand"].(string)
+	switch brand {
+	case "joyent", "joyent-minimal", "lx", "kvm", "bhyve":
+	default:
+		return "", fmt.Sprintf("Failed to create VM: Invalid value(s) for: brand\n"), 1
+	}
+
+	if imageUUID, ok := vm["image_uuid"].(string); ok {
+		if _, installed := f.installedImages[imageUUID]; !installed {
+			return "", fmt.Sprintf("Failed to create VM: image %s is not installed\n", imageUUID), 1
+		}
+	}
+
+	id, ok := vm["uuid"].(string)
+	if !ok {
+		id = uuid.New().String()
+		vm["uuid"] = id
+	}
+
+	if _, exists := f.machines[id]; exists {
+		return "", fmt.Sprintf("Failed to create VM: VM with uuid %s already exists\n", id), 1
+	}
+
+	f.completeMachine(vm)
+	f.machines[id] = vm
+
+	time.AfterFunc(f.bootDelay, func() {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		f.boot(vm)
+	})
+
+	return "", fmt.Sprintf("Successfully created VM %s\n", id), 0
+}
+
+// boot finishes provisioning a created VM: it starts running and its guest publishes the boot
+// metadata.
+func (f *fakeSmartOS) boot(vm map[string]interface{}) {
+	vm["state"] = "running"
+	vm["zone_state"] = "running"
+
+	metadata := vm["customer_metadata"].(map[string]interface{})
+	for k, v := range f.bootMetadata {
+		metadata[k] = v
+	}
+}
+
+// completeMachine fills in the properties vmadm adds to every VM.
+func (f *fakeSmartOS) completeMachine(vm map[string]interface{}) {
+	id := vm["uuid"].(string)
+
+	vm["zonename"] = id
+	vm["zonepath"] = "/zones/" + id
+	vm["state"] = "running"
+	vm["zone_state"] = "running"
+	if f.bootDelay > 0 {
+		vm["state"] = "provisioning"
+		vm["zone_state"] = "installed"
+	}
+	vm["create_timestamp"] = time.Now().UTC().Format(time.RFC3339)
+
+	if _, ok := vm["autoboot"]; !ok {
+		vm["autoboot"] = true
+	}
+
+	if _, ok := vm["customer_metadata"]; !ok {
+		vm["customer_metadata"] = map[string]interface{}{}
+	}
+
+	if _, ok := vm["resolvers"]; !ok {
+		vm["resolvers"] = []interface{}{}
+	}
+
+	// vmadm lists the delegated dataset instead of reporting delegate_dataset.
+	if vm["delegate_dataset"] == true {
+		vm["datasets"] = []interface{}{"zones/" + id + "/data"}
+	}
+	delete(vm, "delegate_dataset")
+
+	nics, _ := vm["nics"].([]interface{})
+	for i, n := range nics {
+		f.completeNIC(n.(map[string]interface{}), i == 0)
+	}
+
+	disks, _ := vm["disks"].([]interface{})
+	for i, d := range disks {
+		f.completeDisk(id, d.(map[string]interface{}), i)
+	}
+}
+
+func (f *fakeSmartOS) completeNIC(nic map[string]interface{}, primary bool) {
+	if _, ok := nic["mac"]; !ok {
+		f.nextMAC++
+		nic["mac"] = fmt.Sprintf("90:b8:d0:00:00:%02x", f.nextMAC)
+	}
+
+	if ips, ok := nic["ips"].([]interface{}); ok && len(ips) > 0 {
+		nic["ip"] = strings.SplitN(ips[0].(string), "/", 2)[0]
+	}
+
+	if primary {
+		nic["primary"] = true
+	}
+}
+
+func (f *fakeSmartOS) completeDisk(id string, disk map[string]interface{}, index int) {
+	if path, _ := disk["path"].(string); path == "" {
+		disk["path"] = fmt.Sprintf("/dev/zvol/rdsk/zones/%s/disk%d", id, index)
+	}
+
+	disk["zfs_filesystem"] = strings.TrimPrefix(disk["path"].(string), "/dev/zvol/rdsk/")
+
+	if _, ok := disk["size"]; !ok {
+		disk["size"] = 10240
+	}
+}
+
+// nextDiskIndex returns the lowest disk number not used by the paths of disks.
+func (f *fakeSmartOS) nextDiskIndex(disks []interface{}) int {
+	used := map[string]bool{}
+	for _, disk := range disks {
+		used[disk.(map[string]interface{})["path"].(string)] = true
+	}
+
+	for index := 0; ; index++ {
+		suffix := fmt.Sprintf("/disk%d", index)
+		free := true
+		for path := range used {
+			if strings.HasSuffix(path, suffix) {
+				free = false
+			}
+		}
+		if free {
+			return index
+		}
+	}
+}
+
+func (f *fakeSmartOS) vmadmGet(args []string) (string, string, uint32) {
+	if len(args) != 1 {
+		return "", "Usage: vmadm get <uuid>\n", 2
+	}
+
+	vm, ok := f.machines[args[0]]
+	if !ok {
+		return "", fmt.Sprintf("Failed to get VM %s: No such zone configured\n", args[0]), 1
+	}
+
+	output, _ := json.MarshalIndent(vm, "", "  ")
+	return string(output) + "\n", "", 0
+}
+
+// fakeListKeys names the property identifying the elements of each list property for
+// update_*, remove_* operations.
+var fakeListKeys = map[string]string{
+	"nics":        "mac",
+	"disks":       "path",
+	"filesystems": "target",
+}
+
+func (f *fakeSmartOS) vmadmUpdate(args []string, stdin []byte) (string, string, uint32) {
+	if len(args) != 1 {
+		return "", "Usage: vmadm update <uuid>\n", 2
+	}
+
+	vm, ok := f.machines[args[0]]
+	if !ok {
+		return "", fmt.Sprintf("Failed to update VM %s: No such zone configured\n", args[0]), 1
+	}
+
+	var update map[string]interface{}
+	if err := json.Unmarshal(stdin, &update); err != nil {
+		return "", fmt.Sprintf("Failed to update VM %s: Invalid JSON payload: %s\n", args[0], err), 1
+	}
+
+	for _, key := range []string{"uuid", "brand", "zonename", "zonepath", "image_uuid", "delegate_dataset"} {
+		if value, ok := update[key]; ok && key != "uuid" && value != vm[key] {
+			return "", fmt.Sprintf("Failed to update VM %s: Invalid value(s) for: %s\n", args[0], key), 1
+		}
+	}
+
+	// vmadm removes list elements before it adds new ones, so an element can be replaced.
+	keys := make([]string, 0, len(update))
+	for key := range update {
+		keys = append(keys, key)
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		return strings.HasPrefix(keys[i], "remove_") && !strings.HasPrefix(keys[j], "remove_")
+	})
+
+	for _, key := range keys {
+		value := update[key]
+		switch {
+		case key == "uuid":
+		case strings.HasPrefix(key, "set_"):
+			property := strings.TrimPrefix(key, "set_")
+			target, _ := vm[property].(map[string]interface{})
+			if target == nil {
+				target = map[string]interface{}{}
+			}
+			for k, v := range value.(map[string]interface{}) {
+				target[k] = v
+			}
+			vm[property] = target
+		case strings.HasPrefix(key, "remove_"):
+			property := strings.TrimPrefix(key, "remove_")
+			f.removeFromProperty(vm, property, value.([]interface{}))
+		case strings.HasPrefix(key, "add_"):
+			property := strings.TrimPrefix(key, "add_")
+			list, _ := vm[property].([]interface{})
+			for _, item := range value.([]interface{}) {
+				element := item.(map[string]interface{})
+				switch property {
+				case "nics":
+					if element["primary"] == true {
+						for _, existing := range list {
+							delete(existing.(map[string]interface{}), "primary")
+						}
+					}
+					f.completeNIC(element, len(list) == 0)
+				case "disks":
+					f.completeDisk(args[0], element, f.nextDiskIndex(list))
+				case "filesystems":
+					for _, existing := range list {
+						if existing.(map[string]interface{})["target"] == element["target"] {
+							return "", fmt.Sprintf("Failed to update VM %s: Invalid value(s) for: filesystems.target\n", args[0]), 1
+						}
+					}
+				}
+				list = append(list, element)
+			}
+			vm[property] = list
+		case strings.HasPrefix(key, "update_"):
+			property := strings.TrimPrefix(key, "update_")
+			identifier := fakeListKeys[property]
+			list, _ := vm[property].([]interface{})
+			for _, item := range value.([]interface{}) {
+				changes := item.(map[string]interface{})
+				found := false
+				for _, element := range list {
+					element := element.(map[string]interface{})
+					if element[identifier] == changes[identifier] {
+						if size, ok := changes["size"].(float64); ok && property == "disks" && size < element["size"].(float64) {
+							return "", fmt.Sprintf("Failed to update VM %s: cannot shrink disk %s\n", args[0], element["path"]), 1
+						}
+						for k, v := range changes {
+							element[k] = v
+						}
+						if property == "nics" {
+							f.completeNIC(element, false)
+						}
+						found = true
+					} else if property == "nics" && changes["primary"] == true {
+						delete(element, "primary")
+					}
+				}
+				if !found {
+					return "", fmt.Sprintf("Failed to update VM %s: Invalid value(s) for: %s.%s\n", args[0], property, identifier), 1
+				}
+			}
+		case key == "indestructible_zoneroot" || key == "indestructible_delegated":
+			// vmadm only reports the flags while they are set.
+			if value == true {
+				vm[key] = true
+			} else {
+				delete(vm, key)
+			}
+		default:
+			vm[key] = value
+		}
+	}
+
+	return "", fmt.Sprintf("Successfully updated VM %s\n", args[0]), 0
+}
+
+func (f *fakeSmartOS) removeFromProperty(vm map[string]interface{}, property string, keys []interface{}) {
+	switch target := vm[property].(type) {
+	case map[string]interface{}:
+		for _, key := range keys {
+			delete(target, key.(string))
+		}
+	case []interface{}:
+		identifier := fakeListKeys[property]
+		var remaining []interface{}
+		for _, element := range target {
+			removed := false
+			for _, key := range keys {
+				if element.(map[string]interface{})[identifier] == key {
+					removed = true
+				}
+			}
+			if !removed {
+				remaining = append(remaining, element)
+			}
+		}
+		vm[property] = remaining
+	}
+}
+
+func (f *fakeSmartOS) vmadmDelete(args []string) (string, string, uint32) {
+	if len(args) != 1 {
+		return "", "Usage: vmadm delete <uuid>\n", 2
+	}
+
+	vm, ok := f.machines[args[0]]
+	if !ok {
+		return "", fmt.Sprintf("Failed to delete VM %s: No such zone configured\n", args[0]), 1
+	}
+
+	for _, key := range []string{"indestructible_zoneroot", "indestructible_delegated"} {
+		if vm[key] == true {
+			return "", fmt.Sprintf("Failed to delete VM %s: %s is set, cannot delete\n", args[0], key), 1
+		}
+	}
+
+	delete(f.machines, args[0])
+	return "", fmt.Sprintf("Successfully deleted VM %s\n", args[0]), 0
+}
+
+func (f *fakeSmartOS) vmadmSetState(args []string, action string, state string) (string, string, uint32) {
+	if len(args) != 1 {
+		return "", fmt.Sprintf("Usage: vmadm %s <uuid>\n", action), 2
+	}
+
+	vm, ok := f.machines[args[0]]
+	if !ok {
+		return "", fmt.Sprintf("Failed to %s VM %s: No such zone configured\n", action, args[0]), 1
+	}
+
+	if vm["state"] == state {
+		return "", fmt.Sprintf("Failed to %s VM %s: VM is already %s\n", action, args[0], state), 1
+	}
+
+	vm["state"] = state
+	if state == "running" {
+		vm["zone_state"] = "running"
+	} else {
+		vm["zone_state"] = "installed"
+	}
+
+	return "", fmt.Sprintf("Successfully completed %s for VM %s\n", action, args[0]), 0
+}
+
+func (f *fakeSmartOS) vmadmReboot(args []string) (string, string, uint32) {
+	if len(args) != 1 {
+		return "", "Usage: vmadm reboot <uuid>\n", 2
+	}
+
+	vm, ok := f.machines[args[0]]
+	if !ok {
+		return "", fmt.Sprintf("Failed to reboot VM %s: No such zone configured\n", args[0]), 1
+	}
+
+	if vm["state"] != "running" {
+		return "", fmt.Sprintf("Failed to reboot VM %s: VM is not running\n", args[0]), 1
+	}
+
+	return "", fmt.Sprintf("Successfully completed reboot for VM %s\n", args[0]), 0
+}
+
+// vmadmList supports `vmadm list -p -o field,... [field=value ...]`.
+func (f *fakeSmartOS) vmadmList(args []string) (string, string, uint32) {
+	fields := []string{"uuid", "type", "ram", "state", "alias"}
+	filters := map[string]string{}
+
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "-p" || args[i] == "-H":
+		case args[i] == "-o" && i+1 < len(args):
+			fields = strings.Split(args[i+1], ",")
+			i++
+		case strings.Contains(args[i], "="):
+			parts := strings.SplitN(args[i], "=", 2)
+			filters[parts[0]] = parts[1]
+		default:
+			return "", fmt.Sprintf("Invalid argument: %s\n", args[i]), 2
+		}
+	}
+
+	var ids []string
+	for id := range f.machines {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var output strings.Builder
+	for _, id := range ids {
+		vm := f.machines[id]
+
+		matches := true
+		for field, value := range filters {
+			if fmt.Sprint(vm[field]) != value {
+				matches = false
+			}
+		}
+
+		if !matches {
+			continue
+		}
+
+		var values []string
+		for _, field := range fields {
+			value := ""
+			if v, ok := vm[field]; ok {
+				value = fmt.Sprint(v)
+			}
+			values = append(values, value)
+		}
+		output.WriteString(strings.Join(values, ":") + "\n")
+	}
+
+	return output.String(), "", 0
+}
+
+func (f *fakeSmartOS) imgadmList(images map[string]fakeImage, args []string) (string, string, uint32) {
+	filters := map[string]string{}
+	for _, arg := range args {
+		if arg == "-j" {
+			continue
+		}
+
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			return "", fmt.Sprintf("imgadm: error (Usage): invalid filter: \"%s\"\n", arg), 1
+		}
+		filters[parts[0]] = parts[1]
+	}
+
+	result := []interface{}{}
+	for _, image := range images {
+		if name, ok := filters["name"]; ok && name != image.Name {
+			continue
+		}
+		if version, ok := filters["version"]; ok && version != image.Version {
+			continue
+		}
+
+		result = append(result, map[string]interface{}{
+			"manifest": map[string]interface{}{
+				"v":       2,
+				"uuid":    image.UUID,
+				"name":    image.Name,
+				"version": image.Version,
+				"os":      image.OS,
+				"type":    "zone-dataset",
+				"state":   "active",
+			},
+			"zpool":  "zones",
+			"source": "https://images.joyent.com",
+		})
+	}
+
+	output, _ := json.MarshalIndent(result, "", "  ")
+	return string(output) + "\n", "", 0
+}
+
+func (f *fakeSmartOS) imgadmImport(args []string) (string, string, uint32) {
+	if len(args) != 1 {
+		return "", "imgadm: error (Usage): incorrect number of args\n", 1
+	}
+
+	if image, ok := f.installedImages[args[0]]; ok {
+		return fmt.Sprintf("Image %s (%s@%s) is already installed, skipping\n", image.UUID, image.Name, image.Version), "", 0
+	}
+
+	image, ok := f.availableImages[args[0]]
+	if !ok {
+		return "", fmt.Sprintf("imgadm import: error (ActiveImageNotFound): an active image \"%s\" was not found in image sources\n", args[0]), 1
+	}
+
+	f.installedImages[image.UUID] = image
+	return fmt.Sprintf("Importing %s (%s@%s) from \"https://images.joyent.com\"\nImported image %s (%s@%s)\n",
+		image.UUID, image.Name, image.Version, image.UUID, image.Name, image.Version), "", 0
+}
+
+// splitShellWords splits a command line the way a POSIX shell would for simple commands,
+// rejecting unquoted shell metacharacters so that tests notice unsafe command lines.
+func splitShellWords(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case c == '\'':
+			end := strings.IndexByte(line[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quoted string")
+			}
+			word.WriteString(line[i+1 : i+1+end])
+			i += end + 1
+			inWord = true
+		case c == '"':
+			end := strings.IndexByte(line[i+1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quoted string")
+			}
+			word.WriteString(line[i+1 : i+1+end])
+			i += end + 1
+			inWord = true
+		case c == '\\' && i+1 < len(line):
+			word.WriteByte(line[i+1])
+			i++
+			inWord = true
+		case strings.IndexByte(";&|<>$`()*?~#\n", c) >= 0:
+			return nil, fmt.Errorf("syntax error near unexpected token `%c' at offset %s", c, strconv.Itoa(i))
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+
+	if inWord {
+		words = append(words, word.String())
+	}
+
+	return words, nil
+}
+
+// fakeBastion is an in-process SSH jump host that forwards direct-tcpip channels, the way
+// OpenSSH's ProxyJump uses them.
+type fakeBastion struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+	hostKey  ssh.Signer
+
+	lock    sync.Mutex
+	targets []string
+}
+
+func newFakeBastion(t *testing.T, password string) *fakeBastion {
+	_, hostPrivateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hostKey, err := ssh.NewSignerFromKey(hostPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := &fakeBastion{hostKey: hostKey}
+
+	b.config = &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, attempt []byte) (*ssh.Permissions, error) {
+			if string(attempt) == password {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("wrong password for %s", conn.User())
+		},
+	}
+	b.config.AddHostKey(hostKey)
+
+	b.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go b.serve()
+
+	return b
+}
+
+func (b *fakeBastion) Close() {
+	b.listener.Close()
+}
+
+func (b *fakeBastion) Port() int {
+	return b.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (b *fakeBastion) HostKeyFingerprint() string {
+	return ssh.FingerprintSHA256(b.hostKey.PublicKey())
+}
+
+// Targets returns the addresses the bastion forwarded connections to.
+func (b *fakeBastion) Targets() []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return append([]string{}, b.targets...)
+}
+
+func (b *fakeBastion) serve() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go b.handleConnection(conn)
+	}
+}
+
+func (b *fakeBastion) handleConnection(conn net.Conn) {
+	serverConn, channels, requests, err := ssh.NewServerConn(conn, b.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer serverConn.Close()
+
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "direct-tcpip" {
+			newChannel.Reject(ssh.UnknownChannelType, "only direct-tcpip is supported")
+			continue
+		}
+
+		var payload struct {
+			Address       string
+			Port          uint32
+			OriginAddress string
+			OriginPort    uint32
+		}
+		if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+			newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+
+		target := net.JoinHostPort(payload.Address, strconv.Itoa(int(payload.Port)))
+		targetConn, err := net.Dial("tcp", target)
+		if err != nil {
+			newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			targetConn.Close()
+			continue
+		}
+
+		b.lock.Lock()
+		b.targets = append(b.targets, target)
+		b.lock.Unlock()
+
+		go ssh.DiscardRequests(channelRequests)
+		go func() {
+			io.Copy(targetConn, channel)
+			targetConn.Close()
+		}()
+		go func() {
+			io.Copy(channel, targetConn)
+			channel.Close()
+		}()
+	}
+}
@@ -0,0 +1,84 @@
+package smartos
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+type FirewallRule struct {
+	NodeName    string     `json:"-"`
+	ID          *uuid.UUID `json:"uuid,omitempty"`
+	Rule        string     `json:"rule"`
+	Enabled     bool       `json:"enabled"`
+	Description string     `json:"description,omitempty"`
+}
+
+// firewallRulePattern matches the overall shape of a fwadm rule:
+// FROM <targets> TO <targets> ALLOW|BLOCK <protocol> <ports or types>.
+var firewallRulePattern = regexp.MustCompile(`(?i)^FROM\s+(.+?)\s+TO\s+(.+?)\s+(ALLOW|BLOCK)\s+(tcp|udp|icmp6?|ah|esp)(\s+(.+))?$`)
+
+// validateFirewallRule checks the syntax of a fwadm rule so that mistakes are reported at plan
+// time.  fwadm itself checks the targets.
+func validateFirewallRule(i interface{}, key string) ([]string, []error) {
+	rule := normalizeFirewallRule(i.(string))
+
+	matches := firewallRulePattern.FindStringSubmatch(rule)
+	if matches == nil {
+		return nil, []error{fmt.Errorf("%s: %q is not a fwadm rule of the form FROM <targets> TO <targets> ALLOW|BLOCK <protocol> <ports>", key, rule)}
+	}
+
+	protocol := strings.ToLower(matches[4])
+	ports := strings.ToLower(matches[6])
+
+	switch protocol {
+	case "tcp", "udp":
+		if !strings.HasPrefix(strings.TrimLeft(ports, "( "), "port") {
+			return nil, []error{fmt.Errorf("%s: %s rules need PORT, PORTS or (PORT ... OR PORT ...)", key, protocol)}
+		}
+	case "icmp", "icmp6":
+		if !strings.HasPrefix(strings.TrimLeft(ports, "( "), "type") {
+			return nil, []error{fmt.Errorf("%s: %s rules need TYPE, optionally with CODE", key, protocol)}
+		}
+	}
+
+	return nil, nil
+}
+
+// normalizeFirewallRule collapses whitespace in a rule, as fwadm does when it stores it.
+func normalizeFirewallRule(rule string) string {
+	return strings.Join(strings.Fields(rule), " ")
+}
+
+// firewallRuleWords are the words of the fwadm rule syntax, in the case fwadm reports them:
+// keywords in upper case, targets and protocols in lower case.  fwadm reads them in any case.
+var firewallRuleWords = map[string]string{
+	"from": "FROM", "to": "TO", "allow": "ALLOW", "block": "BLOCK", "and": "AND", "or": "OR",
+	"port": "PORT", "ports": "PORTS", "type": "TYPE", "code": "CODE", "priority": "PRIORITY",
+
+	"any": "any", "all": "all", "vms": "vms", "vm": "vm", "ip": "ip", "subnet": "subnet", "tag": "tag",
+
+	"tcp": "tcp", "udp": "udp", "icmp": "icmp", "icmp6": "icmp6", "ah": "ah", "esp": "esp",
+}
+
+// firewallRuleToken matches a quoted string or a word of a rule.
+var firewallRuleToken = regexp.MustCompile(`"[^"]*"|[^\s()=,"]+`)
+
+// canonicalFirewallRule returns a rule as fwadm reports it.  Tag names and values, VM UUIDs and
+// addresses keep their case.
+func canonicalFirewallRule(rule string) string {
+	return firewallRuleToken.ReplaceAllStringFunc(normalizeFirewallRule(rule), func(token string) string {
+		if word, ok := firewallRuleWords[strings.ToLower(token)]; ok {
+			return word
+		}
+		return token
+	})
+}
+
+// firewallRulesEqual reports whether two rules only differ in whitespace and the case of fwadm
+// keywords, targets and protocols.  fwadm reports rules with upper case keywords.
+func firewallRulesEqual(a string, b string) bool {
+	return canonicalFirewallRule(a) == canonicalFirewallRule(b)
+}
@@ -0,0 +1,303 @@
+package smartos
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
+	"golang.org/x/crypto/ssh"
+)
+
+// Host describes how to reach the global zone of a SmartOS node, or one of the bastion hosts
+// leading to it.
+type Host struct {
+	Name        string
+	Address     string
+	Port        int
+	User        string
+	Credentials Credentials
+	HostKey     string
+
+	// Bastions lists the jump hosts the connection is tunnelled through, outermost first.
+	Bastions []*Host
+
+	// Executor selects how commands are run on the node: "ssh" or "local".
+	Executor string
+
+	// MaxSessions limits the concurrent SSH sessions and MaxConcurrentProvisions the
+	// concurrent vmadm create and imgadm import operations on the node.  Zero is unlimited.
+	MaxSessions             int
+	MaxConcurrentProvisions int
+
+	authMethods []ssh.AuthMethod
+	sessions    semaphore
+	provisions  semaphore
+}
+
+// Endpoint returns the address:port the node's SSH server listens on.
+func (h *Host) Endpoint() string {
+	return net.JoinHostPort(h.Address, strconv.Itoa(h.Port))
+}
+
+// connectionSchema returns the connection settings shared by host and bastion blocks.
+func connectionSchema() map[string]*schema.Schema {
+	return map[string]*schema.Schema{
+		"address": {
+			Type:        schema.TypeString,
+			Required:    true,
+			Description: "Host name or IP address.",
+		},
+		"port": {
+			Type:        schema.TypeInt,
+			Optional:    true,
+			Description: "SSH port.  Defaults to the provider's `port` for hosts and to 22 for bastions.",
+		},
+		"user": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Description: "User to authenticate with.  Defaults to the provider's `user`.",
+		},
+		"private_key": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Sensitive:   true,
+			Description: "PEM or OpenSSH encoded private key to authenticate with.",
+		},
+		"private_key_file": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Description: "Path of a private key file to authenticate with.",
+		},
+		"private_key_passphrase": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Sensitive:   true,
+			Description: "Passphrase used to decrypt `private_key` or `private_key_file`.",
+		},
+		"certificate": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Description: "OpenSSH user certificate signing `private_key` or `private_key_file`.",
+		},
+		"certificate_file": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Description: "Path of an OpenSSH user certificate signing `private_key` or `private_key_file`.",
+		},
+		"password": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Sensitive:   true,
+			Description: "Password used for password and keyboard-interactive authentication.",
+		},
+		"host_key": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Description: "Pinned host key, either a SHA256 fingerprint or a public key in authorized_keys format.",
+		},
+	}
+}
+
+func bastionSchema() *schema.Resource {
+	return &schema.Resource{
+		Schema: connectionSchema(),
+	}
+}
+
+func hostSchema() *schema.Resource {
+	hostSchema := connectionSchema()
+
+	hostSchema["name"] = &schema.Schema{
+		Type:        schema.TypeString,
+		Required:    true,
+		Description: "Node name used by the `node_name` argument of resources and data sources.",
+	}
+
+	// Hosts using the local executor have no address.
+	hostSchema["address"].Required = false
+	hostSchema["address"].Optional = true
+	hostSchema["address"].Description = "Host name or IP address.  Required unless `executor` is `local`."
+
+	hostSchema["executor"] = &schema.Schema{
+		Type:         schema.TypeString,
+		Optional:     true,
+		Default:      "ssh",
+		ValidateFunc: validation.StringInSlice([]string{"ssh", "local"}, false),
+		Description:  "How commands are run on the node: `ssh` connects to the global zone, `local` runs `vmadm` and `imgadm` directly, for when Terraform itself runs in the node's global zone.",
+	}
+
+	hostSchema["max_sessions"] = &schema.Schema{
+		Type:         schema.TypeInt,
+		Optional:     true,
+		ValidateFunc: validation.IntAtLeast(0),
+		Description:  "Maximum number of concurrent SSH sessions on this node.  Defaults to the provider's `max_sessions`, which 0 falls back to as well, so only the provider-level limit can be made unlimited.",
+	}
+
+	hostSchema["max_concurrent_provisions"] = &schema.Schema{
+		Type:         schema.TypeInt,
+		Optional:     true,
+		ValidateFunc: validation.IntAtLeast(0),
+		Description:  "Maximum number of concurrent `vmadm create` and `imgadm import` operations on this node.  Defaults to the provider's `max_concurrent_provisions`, which 0 falls back to as well, so only the provider-level limit can be made unlimited.",
+	}
+
+	hostSchema["bastion"] = &schema.Schema{
+		Type:        schema.TypeList,
+		Optional:    true,
+		Elem:        bastionSchema(),
+		Description: "Jump hosts to reach this node through, replacing the provider's `bastion` chain.",
+	}
+
+	return &schema.Resource{
+		Schema: hostSchema,
+	}
+}
+
+// getHosts merges the legacy `hosts` map with the `host` blocks of the provider
+// configuration.  Settings not given for a host fall back to the provider-level defaults.
+func getHosts(d *schema.ResourceData, defaults Host) (map[string]*Host, error) {
+	hosts := map[string]*Host{}
+
+	for name, address := range d.Get("hosts").(map[string]interface{}) {
+		host := defaults
+		host.Name = name
+		host.Address = address.(string)
+		host.Executor = "ssh"
+
+		// The map form has no room for a port so allow it to be given as address:port.
+		if hostname, port, err := net.SplitHostPort(host.Address); err == nil {
+			portNumber, err := strconv.Atoi(port)
+			if err != nil {
+				return nil, fmt.Errorf("invalid port in address %s of host %s", host.Address, name)
+			}
+
+			host.Address = hostname
+			host.Port = portNumber
+		}
+
+		hosts[name] = &host
+	}
+
+	for _, hd := range d.Get("host").([]interface{}) {
+		hostDefinition := hd.(map[string]interface{})
+
+		host := getHost(hostDefinition, defaults)
+		host.Name = hostDefinition["name"].(string)
+
+		if _, ok := hosts[host.Name]; ok {
+			if _, ok := d.Get("hosts").(map[string]interface{})[host.Name]; ok {
+				return nil, fmt.Errorf("host %s is defined in both hosts and a host block", host.Name)
+			}
+
+			return nil, fmt.Errorf("more than one host block is named %s", host.Name)
+		}
+
+		host.Executor = hostDefinition["executor"].(string)
+		if host.Executor == "ssh" && host.Address == "" {
+			return nil, fmt.Errorf("host %s requires an address", host.Name)
+		}
+
+		// Unset and 0 cannot be told apart in a block, so both use the provider's limit.
+		if maxSessions := hostDefinition["max_sessions"].(int); maxSessions > 0 {
+			host.MaxSessions = maxSessions
+		}
+
+		if maxConcurrentProvisions := hostDefinition["max_concurrent_provisions"].(int); maxConcurrentProvisions > 0 {
+			host.MaxConcurrentProvisions = maxConcurrentProvisions
+		}
+
+		if bastions := hostDefinition["bastion"].([]interface{}); len(bastions) > 0 {
+			host.Bastions = getBastions(bastions, defaults)
+		}
+
+		hosts[host.Name] = host
+	}
+
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("at least one host must be configured through hosts or a host block")
+	}
+
+	for _, host := range hosts {
+		host.sessions = newSemaphore(host.MaxSessions)
+		host.provisions = newSemaphore(host.MaxConcurrentProvisions)
+	}
+
+	return hosts, nil
+}
+
+// getBastions returns the jump host chain described by a list of bastion blocks.  Bastions
+// share the provider's user and credentials unless they set their own.
+func getBastions(bastionDefinitions []interface{}, defaults Host) []*Host {
+	var bastions []*Host
+
+	for _, bd := range bastionDefinitions {
+		bastionDefaults := defaults
+		bastionDefaults.Port = 22
+		bastionDefaults.HostKey = ""
+		bastionDefaults.Bastions = nil
+
+		bastion := getHost(bd.(map[string]interface{}), bastionDefaults)
+		bastion.Name = fmt.Sprintf("bastion %s", bastion.Address)
+
+		bastions = append(bastions, bastion)
+	}
+
+	return bastions
+}
+
+func getHost(definition map[string]interface{}, defaults Host) *Host {
+	host := defaults
+	host.Address = definition["address"].(string)
+
+	if port := definition["port"].(int); port > 0 {
+		host.Port = port
+	}
+
+	if user := definition["user"].(string); user != "" {
+		host.User = user
+	}
+
+	host.Credentials = mergeCredentials(defaults.Credentials, getCredentials(definition))
+
+	if hostKey := definition["host_key"].(string); hostKey != "" {
+		host.HostKey = hostKey
+	}
+
+	return &host
+}
+
+func getCredentials(definition map[string]interface{}) Credentials {
+	return Credentials{
+		PrivateKey:           definition["private_key"].(string),
+		PrivateKeyFile:       definition["private_key_file"].(string),
+		PrivateKeyPassphrase: definition["private_key_passphrase"].(string),
+		Password:             definition["password"].(string),
+		Certificate:          definition["certificate"].(string),
+		CertificateFile:      definition["certificate_file"].(string),
+	}
+}
+
+// mergeCredentials overlays host specific credentials on the provider defaults.  A host that
+// sets its own private key also replaces the default passphrase and certificate, since those
+// only make sense together with the key they belong to.
+func mergeCredentials(defaults Credentials, overrides Credentials) Credentials {
+	credentials := defaults
+
+	if overrides.PrivateKey != "" || overrides.PrivateKeyFile != "" {
+		credentials.PrivateKey = overrides.PrivateKey
+		credentials.PrivateKeyFile = overrides.PrivateKeyFile
+		credentials.PrivateKeyPassphrase = overrides.PrivateKeyPassphrase
+		credentials.Certificate = overrides.Certificate
+		credentials.CertificateFile = overrides.CertificateFile
+	} else if overrides.Certificate != "" || overrides.CertificateFile != "" {
+		credentials.Certificate = overrides.Certificate
+		credentials.CertificateFile = overrides.CertificateFile
+	}
+
+	if overrides.Password != "" {
+		credentials.Password = overrides.Password
+	}
+
+	return credentials
+}
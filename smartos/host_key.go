@@ -0,0 +1,188 @@
+package smartos
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// HostKeyVerifier checks the host keys presented by SmartOS global zones and bastions against
+// pinned fingerprints and known_hosts files, optionally trusting unknown hosts on first use.
+type HostKeyVerifier struct {
+	KnownHostsFile        string
+	ManagedKnownHostsFile string
+	TrustOnFirstUse       bool
+
+	lock sync.Mutex
+}
+
+// HostKeyMismatchError is returned when a node presents a host key that differs from the
+// one that was pinned or recorded for it.
+type HostKeyMismatchError struct {
+	NodeName string
+	Address  string
+	Actual   string
+	Expected []string
+}
+
+func (e *HostKeyMismatchError) Error() string {
+	return fmt.Sprintf("SSH host key mismatch for node %s (%s): presented key %s does not match expected %s",
+		e.NodeName, e.Address, e.Actual, strings.Join(e.Expected, ", "))
+}
+
+// HostKeyCallback returns an ssh.HostKeyCallback that verifies the host key of the named node.
+// When pinnedHostKey is set the known_hosts files are not consulted.
+func (v *HostKeyVerifier) HostKeyCallback(nodeName string, pinnedHostKey string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		return v.verify(nodeName, pinnedHostKey, hostname, remote, key)
+	}
+}
+
+func (v *HostKeyVerifier) verify(nodeName string, expected string, hostname string, remote net.Addr, key ssh.PublicKey) error {
+	fingerprint := ssh.FingerprintSHA256(key)
+
+	if expected != "" {
+		if !hostKeyMatches(expected, key) {
+			return &HostKeyMismatchError{
+				NodeName: nodeName,
+				Address:  hostname,
+				Actual:   fingerprint,
+				Expected: []string{expected},
+			}
+		}
+
+		log.Printf("SSH: Host key for node %s matches pinned fingerprint %s", nodeName, fingerprint)
+		return nil
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	var files []string
+	for _, file := range []string{v.KnownHostsFile, v.ManagedKnownHostsFile} {
+		if file == "" {
+			continue
+		}
+
+		path, err := expandPath(file)
+		if err != nil {
+			return err
+		}
+
+		if _, err := os.Stat(path); err == nil {
+			files = append(files, path)
+		}
+	}
+
+	var err error
+	if len(files) > 0 {
+		callback, cerr := knownhosts.New(files...)
+		if cerr != nil {
+			return fmt.Errorf("failed to load known_hosts files %s: %s", strings.Join(files, ", "), cerr)
+		}
+		err = callback(hostname, remote, key)
+	} else {
+		// No known_hosts file exists yet so every host is unknown.
+		err = &knownhosts.KeyError{}
+	}
+
+	if err == nil {
+		return nil
+	}
+
+	var revokedError *knownhosts.RevokedError
+	if errors.As(err, &revokedError) {
+		return fmt.Errorf("SSH host key %s for node %s (%s) has been revoked", fingerprint, nodeName, hostname)
+	}
+
+	var keyError *knownhosts.KeyError
+	if !errors.As(err, &keyError) {
+		return err
+	}
+
+	if len(keyError.Want) > 0 {
+		var expected []string
+		for _, want := range keyError.Want {
+			expected = append(expected, fmt.Sprintf("%s (%s:%d)", ssh.FingerprintSHA256(want.Key), want.Filename, want.Line))
+		}
+
+		return &HostKeyMismatchError{
+			NodeName: nodeName,
+			Address:  hostname,
+			Actual:   fingerprint,
+			Expected: expected,
+		}
+	}
+
+	if !v.TrustOnFirstUse || v.ManagedKnownHostsFile == "" {
+		return fmt.Errorf("SSH host key %s for node %s (%s) is unknown; add it to the known_hosts file, pin its fingerprint or enable trust_on_first_use",
+			fingerprint, nodeName, hostname)
+	}
+
+	log.Printf("SSH: Trusting host key %s for node %s (%s) on first use", fingerprint, nodeName, hostname)
+	return v.addKnownHost(hostname, key)
+}
+
+func (v *HostKeyVerifier) addKnownHost(hostname string, key ssh.PublicKey) error {
+	path, err := expandPath(v.ManagedKnownHostsFile)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = fmt.Fprintln(file, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key))
+	return err
+}
+
+// hostKeyMatches compares a presented host key with a pinned value, which may be a SHA256
+// fingerprint, a legacy MD5 fingerprint or a public key in authorized_keys format.
+func hostKeyMatches(expected string, key ssh.PublicKey) bool {
+	expected = strings.TrimSpace(expected)
+
+	switch {
+	case strings.HasPrefix(expected, "SHA256:"):
+		return expected == ssh.FingerprintSHA256(key)
+	case strings.HasPrefix(expected, "MD5:"):
+		return strings.EqualFold(strings.TrimPrefix(expected, "MD5:"), ssh.FingerprintLegacyMD5(key))
+	case strings.Count(expected, ":") == 15:
+		return strings.EqualFold(expected, ssh.FingerprintLegacyMD5(key))
+	}
+
+	pinnedKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(expected))
+	if err != nil {
+		return false
+	}
+
+	return string(pinnedKey.Marshal()) == string(key.Marshal())
+}
+
+func expandPath(path string) (string, error) {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, strings.TrimPrefix(path, "~")), nil
+}
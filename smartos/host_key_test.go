@@ -0,0 +1,176 @@
+package smartos
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func testHostKey(t *testing.T) ssh.PublicKey {
+	publicKey, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func TestHostKeyVerifier(t *testing.T) {
+	const address = "10.0.0.1:22"
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 22}
+
+	key := testHostKey(t)
+	otherKey := testHostKey(t)
+
+	knownHost := knownhosts.Line([]string{knownhosts.Normalize(address)}, key)
+	otherKnownHost := knownhosts.Line([]string{knownhosts.Normalize(address)}, otherKey)
+
+	for _, tc := range []struct {
+		name            string
+		pinned          string
+		knownHosts      string
+		managed         string
+		trustOnFirstUse bool
+		err             string
+		mismatch        bool
+		recorded        bool
+	}{
+		{
+			name:   "pinned fingerprint",
+			pinned: ssh.FingerprintSHA256(key),
+		},
+		{
+			// The known_hosts files are not consulted for pinned keys.
+			name:       "pinned key overrides known_hosts",
+			pinned:     strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))),
+			knownHosts: otherKnownHost,
+		},
+		{
+			name:       "pinned mismatch",
+			pinned:     ssh.FingerprintSHA256(otherKey),
+			knownHosts: knownHost,
+			err:        "does not match expected " + ssh.FingerprintSHA256(otherKey),
+			mismatch:   true,
+		},
+		{
+			name:       "known_hosts",
+			knownHosts: knownHost,
+		},
+		{
+			name:     "managed known_hosts",
+			managed:  knownHost,
+			recorded: true,
+		},
+		{
+			// A host with a different key on record is not trusted anew.
+			name:            "known_hosts mismatch",
+			knownHosts:      otherKnownHost,
+			trustOnFirstUse: true,
+			err:             ssh.FingerprintSHA256(otherKey) + " (KNOWN_HOSTS:1)",
+			mismatch:        true,
+		},
+		{
+			name:            "revoked",
+			knownHosts:      "@revoked * " + strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))),
+			trustOnFirstUse: true,
+			err:             "has been revoked",
+		},
+		{
+			name:       "unknown",
+			knownHosts: knownhosts.Line([]string{"10.0.0.2"}, otherKey),
+			err:        "is unknown; add it to the known_hosts file",
+		},
+		{
+			name:            "trust on first use",
+			knownHosts:      knownhosts.Line([]string{"10.0.0.2"}, otherKey),
+			trustOnFirstUse: true,
+			recorded:        true,
+		},
+		{
+			// The managed file and its directory are created for the first host.
+			name:            "trust on first use without known_hosts files",
+			trustOnFirstUse: true,
+			recorded:        true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "host_keys")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			verifier := &HostKeyVerifier{
+				KnownHostsFile:        filepath.Join(dir, "known_hosts"),
+				ManagedKnownHostsFile: filepath.Join(dir, "terraform.d", "smartos_known_hosts"),
+				TrustOnFirstUse:       tc.trustOnFirstUse,
+			}
+
+			if tc.knownHosts != "" {
+				if err := ioutil.WriteFile(verifier.KnownHostsFile, []byte(tc.knownHosts+"\n"), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if tc.managed != "" {
+				if err := os.MkdirAll(filepath.Dir(verifier.ManagedKnownHostsFile), 0700); err != nil {
+					t.Fatal(err)
+				}
+
+				if err := ioutil.WriteFile(verifier.ManagedKnownHostsFile, []byte(tc.managed+"\n"), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err = verifier.HostKeyCallback("node1", tc.pinned)(address, remote, key)
+
+			if tc.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			} else {
+				want := strings.Replace(tc.err, "KNOWN_HOSTS", verifier.KnownHostsFile, 1)
+				if err == nil || !strings.Contains(err.Error(), want) {
+					t.Fatalf("error = %v, want one containing %q", err, want)
+				}
+			}
+
+			var mismatchError *HostKeyMismatchError
+			if errors.As(err, &mismatchError) != tc.mismatch {
+				t.Errorf("error = %#v, want a *HostKeyMismatchError: %t", err, tc.mismatch)
+			}
+
+			managed, _ := ioutil.ReadFile(verifier.ManagedKnownHostsFile)
+			if recorded := strings.Contains(string(managed), knownHost); recorded != tc.recorded {
+				t.Errorf("managed known_hosts file = %q, want the key recorded: %t", managed, tc.recorded)
+			}
+
+			if !tc.recorded {
+				return
+			}
+
+			// The recorded key is trusted, and no other key is.
+			if err := verifier.HostKeyCallback("node1", "")(address, remote, key); err != nil {
+				t.Errorf("recorded key is not trusted: %v", err)
+			}
+
+			if err := verifier.HostKeyCallback("node1", "")(address, remote, otherKey); !errors.As(err, &mismatchError) {
+				t.Errorf("error = %v for a different key, want a *HostKeyMismatchError", err)
+			}
+		})
+	}
+}
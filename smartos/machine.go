@@ -1,7 +1,10 @@
 package smartos
 
 import (
+	"fmt"
 	"log"
+	"net"
+	"reflect"
 	"strings"
 
 	"github.com/google/uuid"
@@ -15,6 +18,17 @@ type Machine struct {
 	Autoboot *bool      `json:"autoboot,omitempty"`
 	Brand    string     `json:"brand,omitempty"`
 	CPUCap   *uint32    `json:"cpu_cap,omitempty"`
+	CPUType  string     `json:"cpu_type,omitempty"`
+
+	BhyveExtraOpts   string  `json:"bhyve_extra_opts,omitempty"`
+	Bootrom          string  `json:"bootrom,omitempty"`
+	DiskDriver       string  `json:"disk_driver,omitempty"`
+	FlexibleDiskSize *uint32 `json:"flexible_disk_size,omitempty"`
+	NICDriver        string  `json:"nic_driver,omitempty"`
+	VGA              string  `json:"vga,omitempty"`
+	VNCPassword      string  `json:"vnc_password,omitempty"`
+	VNCPort          *int32  `json:"vnc_port,omitempty"`
+
 	/*
 		CPUShares                  uint32             `json:"cpu_shares,omitempty"`
 	*/
@@ -22,48 +36,74 @@ type Machine struct {
 	SetCustomerMetadata    map[string]string `json:"set_customer_metadata,omitempty"`    // for updates
 	RemoveCustomerMetadata []string          `json:"remove_customer_metadata,omitempty"` // for updates
 
-	Disks []Disk `json:"disks,omitempty"`
-
-	/*
-		DelegateDataset            bool               `json:"delegate_dataset,omitempty"`
-		DNSDomain                  string             `json:"dns_domain,omitempty"`
-		FirewallEnabled            bool               `json:"firewall_enabled,omitempty"`
-		Hostname                   string             `json:"hostname,omitempty"`
-	*/
-	ImageUUID *uuid.UUID `json:"image_uuid,omitempty"`
-	/*
-		InternalMetadata           map[string]string  `json:"internal_metadat,omitempty"`
-		InternalMetadataNamespaces map[string]string  `json:"internal_metadata_namespaces,omitempty"`
-		IndestructableDelegated    bool               `json:"indestructible_delegated,omitempty"`
-		IndestructableZoneRoot     bool               `json:"indestructible_zoneroot,omitempty"`
-	*/
-	KernelVersion     string  `json:"kernel_version,omitempty"`
-	MaintainResolvers *bool   `json:"maintain_resolvers,omitempty"`
-	MaxPhysicalMemory *uint32 `json:"max_physical_memory,omitempty"`
+	Disks       []Disk                   `json:"disks,omitempty"`
+	AddDisks    []Disk                   `json:"add_disks,omitempty"`    // for updates
+	UpdateDisks []map[string]interface{} `json:"update_disks,omitempty"` // for updates
+	RemoveDisks []string                 `json:"remove_disks,omitempty"` // for updates
+
+	Filesystems       []Filesystem `json:"filesystems,omitempty"`
+	AddFilesystems    []Filesystem `json:"add_filesystems,omitempty"`    // for updates
+	RemoveFilesystems []string     `json:"remove_filesystems,omitempty"` // for updates
+
+	// vmadm only takes delegate_dataset on create and lists the delegated dataset in datasets.
+	DelegateDataset *bool      `json:"delegate_dataset,omitempty"`
+	Datasets        []string   `json:"datasets,omitempty"`
+	DNSDomain       string     `json:"dns_domain,omitempty"`
+	Hostname        string     `json:"hostname,omitempty"`
+	FirewallEnabled *bool      `json:"firewall_enabled,omitempty"`
+	ImageUUID       *uuid.UUID `json:"image_uuid,omitempty"`
+
+	InternalMetadata       map[string]string `json:"internal_metadata,omitempty"`
+	SetInternalMetadata    map[string]string `json:"set_internal_metadata,omitempty"`    // for updates
+	RemoveInternalMetadata []string          `json:"remove_internal_metadata,omitempty"` // for updates
+
+	// A pointer, so that an update can clear the namespaces with an empty list.
+	InternalMetadataNamespaces *[]string `json:"internal_metadata_namespaces,omitempty"`
+
+	IndestructibleDelegated *bool   `json:"indestructible_delegated,omitempty"`
+	IndestructibleZoneRoot  *bool   `json:"indestructible_zoneroot,omitempty"`
+	KernelVersion           string  `json:"kernel_version,omitempty"`
+	MaintainResolvers       *bool   `json:"maintain_resolvers,omitempty"`
+	MaxPhysicalMemory       *uint32 `json:"max_physical_memory,omitempty"`
 	/*
 		MaxSwap           uint32             `json:"max_swap,omitempty"`
 	*/
 	NetworkInterfaces []NetworkInterface `json:"nics,omitempty"`
-	Quota             *uint32            `json:"quota,omitempty"`
-	RAM               *uint32            `json:"ram,omitempty"`
-	Resolvers         []string           `json:"resolvers,omitempty"`
-	VirtualCPUCount   *uint32            `json:"vcpus,omitempty"`
-	State             string             `json:"state,omitempty"`
-	PrimaryIP         string             `json:"-"`
+
+	AddNetworkInterfaces    []NetworkInterface       `json:"add_nics,omitempty"`    // for updates
+	UpdateNetworkInterfaces []map[string]interface{} `json:"update_nics,omitempty"` // for updates
+	RemoveNetworkInterfaces []string                 `json:"remove_nics,omitempty"` // for updates
+
+	Routes       map[string]string `json:"routes,omitempty"`
+	SetRoutes    map[string]string `json:"set_routes,omitempty"`    // for updates
+	RemoveRoutes []string          `json:"remove_routes,omitempty"` // for updates
+
+	Quota           *uint32  `json:"quota,omitempty"`
+	RAM             *uint32  `json:"ram,omitempty"`
+	Resolvers       []string `json:"resolvers,omitempty"`
+	VirtualCPUCount *uint32  `json:"vcpus,omitempty"`
+	State           string   `json:"state,omitempty"`
+	PrimaryIP       string   `json:"-"`
 
 	Metadata map[string]string `json:"-"`
 }
 
+// UpdatePrimaryIP sets PrimaryIP to the address of the primary NIC.  NICs using dhcp or
+// addrconf get their address from inside the guest, so vmadm has no address to report.
 func (m *Machine) UpdatePrimaryIP() {
 	m.PrimaryIP = ""
 	for _, networkInterface := range m.NetworkInterfaces {
-		if networkInterface.IsPrimary != nil {
-			m.PrimaryIP = networkInterface.IPAddress
+		if networkInterface.IsPrimary != nil && *networkInterface.IsPrimary {
+			if net.ParseIP(networkInterface.IPAddress) != nil {
+				m.PrimaryIP = networkInterface.IPAddress
+			}
 			break
 		}
 	}
 }
 
+// UpdateMetadata moves the customer_metadata keys the guest publishes with the "terraform:"
+// prefix to Metadata, so that they are neither reported as drift nor removed by updates.
 func (m *Machine) UpdateMetadata() {
 	metadata := map[string]string{}
 	prefix := "terraform:"
@@ -86,6 +126,35 @@ func newUint32(value uint32) *uint32 {
 	return &n
 }
 
+func newInt32(value int32) *int32 {
+	n := value
+	return &n
+}
+
+func boolValue(value *bool) bool {
+	if value == nil {
+		return false
+	}
+
+	return *value
+}
+
+func uint32Value(value *uint32) int {
+	if value == nil {
+		return 0
+	}
+
+	return int(*value)
+}
+
+func int32Value(value *int32) int {
+	if value == nil {
+		return 0
+	}
+
+	return int(*value)
+}
+
 func (m *Machine) LoadFromSchema(d *schema.ResourceData) error {
 
 	m.Alias = d.Get("alias").(string)
@@ -100,7 +169,9 @@ func (m *Machine) LoadFromSchema(d *schema.ResourceData) error {
 		m.ImageUUID = &uuid
 	}
 
-	if autoboot, ok := d.GetOk("autoboot"); ok {
+	// GetOk cannot tell an explicit false from an unset bool, and vmadm defaults autoboot to
+	// true.
+	if autoboot, ok := d.GetOkExists("autoboot"); ok {
 		m.Autoboot = newBool(autoboot.(bool))
 	}
 
@@ -108,12 +179,88 @@ func (m *Machine) LoadFromSchema(d *schema.ResourceData) error {
 		m.CPUCap = newUint32(uint32(cpuCap.(int)))
 	}
 
+	if cpuType, ok := d.GetOk("cpu_type"); ok {
+		m.CPUType = cpuType.(string)
+	}
+
+	if bhyveExtraOpts, ok := d.GetOk("bhyve_extra_opts"); ok {
+		m.BhyveExtraOpts = bhyveExtraOpts.(string)
+	}
+
+	if bootrom, ok := d.GetOk("bootrom"); ok {
+		m.Bootrom = bootrom.(string)
+	}
+
+	if delegateDataset, ok := d.GetOkExists("delegate_dataset"); ok {
+		m.DelegateDataset = newBool(delegateDataset.(bool))
+	}
+
+	if dnsDomain, ok := d.GetOk("dns_domain"); ok {
+		m.DNSDomain = dnsDomain.(string)
+	}
+
+	if hostname, ok := d.GetOk("hostname"); ok {
+		m.Hostname = hostname.(string)
+	}
+
+	if diskDriver, ok := d.GetOk("disk_driver"); ok {
+		m.DiskDriver = diskDriver.(string)
+	}
+
+	if firewallEnabled, ok := d.GetOkExists("firewall_enabled"); ok {
+		m.FirewallEnabled = newBool(firewallEnabled.(bool))
+	}
+
+	if flexibleDiskSize, ok := d.GetOk("flexible_disk_size"); ok {
+		m.FlexibleDiskSize = newUint32(uint32(flexibleDiskSize.(int)))
+	}
+
+	if indestructibleDelegated, ok := d.GetOk("indestructible_delegated"); ok {
+		m.IndestructibleDelegated = newBool(indestructibleDelegated.(bool))
+	}
+
+	if indestructibleZoneRoot, ok := d.GetOk("indestructible_zoneroot"); ok {
+		m.IndestructibleZoneRoot = newBool(indestructibleZoneRoot.(bool))
+	}
+
+	if nicDriver, ok := d.GetOk("nic_driver"); ok {
+		m.NICDriver = nicDriver.(string)
+	}
+
+	if vga, ok := d.GetOk("vga"); ok {
+		m.VGA = vga.(string)
+	}
+
+	if vncPassword, ok := d.GetOk("vnc_password"); ok {
+		m.VNCPassword = vncPassword.(string)
+	}
+
+	if vncPort, ok := d.GetOk("vnc_port"); ok {
+		m.VNCPort = newInt32(int32(vncPort.(int)))
+	}
+
 	customerMetaData := map[string]string{}
 	for k, v := range d.Get("customer_metadata").(map[string]interface{}) {
 		customerMetaData[k] = v.(string)
 	}
 	m.CustomerMetadata = customerMetaData
 
+	internalMetadata := map[string]string{}
+	for k, v := range d.Get("internal_metadata").(map[string]interface{}) {
+		internalMetadata[k] = v.(string)
+	}
+	m.InternalMetadata = internalMetadata
+
+	if namespaces, ok := d.GetOk("internal_metadata_namespaces"); ok {
+		m.InternalMetadataNamespaces = getInternalMetadataNamespaces(namespaces)
+	}
+
+	routes := map[string]string{}
+	for destination, gateway := range d.Get("routes").(map[string]interface{}) {
+		routes[destination] = gateway.(string)
+	}
+	m.Routes = routes
+
 	metadata := map[string]string{}
 	for k, v := range d.Get("metadata").(map[string]interface{}) {
 		metadata[k] = v.(string)
@@ -124,6 +271,10 @@ func (m *Machine) LoadFromSchema(d *schema.ResourceData) error {
 		m.Disks, _ = getDisks(disks)
 	}
 
+	if filesystems, ok := d.GetOk("filesystems"); ok {
+		m.Filesystems = getFilesystems(filesystems)
+	}
+
 	if kernelVersion, ok := d.GetOk("kernel_version"); ok {
 		m.KernelVersion = kernelVersion.(string)
 	}
@@ -162,12 +313,82 @@ func (m *Machine) LoadFromSchema(d *schema.ResourceData) error {
 }
 
 func (m *Machine) SaveToSchema(d *schema.ResourceData) error {
-	d.Set("primary_ip", m.PrimaryIP)
-	d.Set("id", m.ID.String())
-	d.Set("node_name", m.NodeName)
+	var imageUUID string
+	if m.ImageUUID != nil {
+		imageUUID = m.ImageUUID.String()
+	}
+
+	// vmadm only reports ram for hardware virtualized machines.  The ram of other zones is
+	// their initial memory cap, which is only adopted on import so that raising
+	// max_physical_memory later does not replace the zone.
+	ram := m.RAM
+	if ram == nil {
+		if current, ok := d.GetOk("ram"); ok {
+			ram = newUint32(uint32(current.(int)))
+		} else {
+			ram = m.MaxPhysicalMemory
+		}
+	}
+
+	resolvers := m.Resolvers
+	if resolvers == nil {
+		resolvers = []string{}
+	}
+
+	namespaces := []string{}
+	if m.InternalMetadataNamespaces != nil {
+		namespaces = *m.InternalMetadataNamespaces
+	}
+
+	values := map[string]interface{}{
+		"node_name":                m.NodeName,
+		"alias":                    m.Alias,
+		"autoboot":                 boolValue(m.Autoboot),
+		"bhyve_extra_opts":         m.BhyveExtraOpts,
+		"bootrom":                  m.Bootrom,
+		"brand":                    m.Brand,
+		"cpu_cap":                  uint32Value(m.CPUCap),
+		"cpu_type":                 m.CPUType,
+		"delegate_dataset":         m.hasDelegatedDataset(),
+		"disk_driver":              m.DiskDriver,
+		"dns_domain":               m.DNSDomain,
+		"hostname":                 m.Hostname,
+		"filesystems":              filesystemsToSchema(m.Filesystems),
+		"firewall_enabled":         boolValue(m.FirewallEnabled),
+		"flexible_disk_size":       uint32Value(m.FlexibleDiskSize),
+		"nic_driver":               m.NICDriver,
+		"vga":                      m.VGA,
+		"vnc_password":             m.VNCPassword,
+		"vnc_port":                 int32Value(m.VNCPort),
+		"customer_metadata":        m.CustomerMetadata,
+		"disks":                    disksToSchema(m.Disks),
+		"image_uuid":               imageUUID,
+		"indestructible_delegated": boolValue(m.IndestructibleDelegated),
+		"indestructible_zoneroot":  boolValue(m.IndestructibleZoneRoot),
+		"kernel_version":           m.KernelVersion,
+		"maintain_resolvers":       boolValue(m.MaintainResolvers),
+		"max_physical_memory":      uint32Value(m.MaxPhysicalMemory),
+		"nics":                     networkInterfacesToSchema(m.NetworkInterfaces),
+		"quota":                    uint32Value(m.Quota),
+		"ram":                      uint32Value(ram),
+		"resolvers":                resolvers,
+		"routes":                   m.Routes,
+		"state":                    m.State,
+		"vcpus":                    uint32Value(m.VirtualCPUCount),
+		"primary_ip":               m.PrimaryIP,
+
+		"internal_metadata":            m.InternalMetadata,
+		"internal_metadata_namespaces": namespaces,
+
+		// We update the metadata in case machine provisioning pushed data there.
+		"metadata": m.Metadata,
+	}
 
-	// We update the metadata in case machine provisioning pushed data there.
-	d.Set("metadata", m.Metadata)
+	for key, value := range values {
+		if err := d.Set(key, value); err != nil {
+			return fmt.Errorf("failed to set %s: %s", key, err)
+		}
+	}
 
 	if m.PrimaryIP != "" {
 		log.Printf("Machine saved to schema with primary IP: '%s'", m.PrimaryIP)
@@ -180,6 +401,22 @@ func (m *Machine) SaveToSchema(d *schema.ResourceData) error {
 	return nil
 }
 
+// hasDelegatedDataset reports whether datasets lists the zone's delegated dataset,
+// <zfs_filesystem>/data.
+func (m *Machine) hasDelegatedDataset() bool {
+	if m.ID == nil {
+		return false
+	}
+
+	for _, dataset := range m.Datasets {
+		if strings.HasSuffix(dataset, "/"+m.ID.String()+"/data") {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (m *Machine) setCustomerMetadata(key string, value interface{}) {
 	if m.SetCustomerMetadata == nil {
 		m.SetCustomerMetadata = make(map[string]string)
@@ -192,6 +429,39 @@ func (m *Machine) removeCustomerMetadata(key string) {
 	m.RemoveCustomerMetadata = append(m.RemoveCustomerMetadata, key)
 }
 
+func (m *Machine) setInternalMetadata(key string, value interface{}) {
+	if m.SetInternalMetadata == nil {
+		m.SetInternalMetadata = make(map[string]string)
+	}
+
+	m.SetInternalMetadata[key] = value.(string)
+}
+
+func (m *Machine) removeInternalMetadata(key string) {
+	m.RemoveInternalMetadata = append(m.RemoveInternalMetadata, key)
+}
+
+func getInternalMetadataNamespaces(d interface{}) *[]string {
+	namespaces := []string{}
+	for _, namespace := range d.([]interface{}) {
+		namespaces = append(namespaces, namespace.(string))
+	}
+
+	return &namespaces
+}
+
+func (m *Machine) setRoute(destination string, gateway interface{}) {
+	if m.SetRoutes == nil {
+		m.SetRoutes = make(map[string]string)
+	}
+
+	m.SetRoutes[destination] = gateway.(string)
+}
+
+func (m *Machine) removeRoute(destination string) {
+	m.RemoveRoutes = append(m.RemoveRoutes, destination)
+}
+
 func stringsAreEqual(a interface{}, b interface{}) bool {
 	return a.(string) == b.(string)
 }
@@ -206,17 +476,16 @@ type NetworkInterface struct {
 	/*
 		BlockedOutgoingPorts  []uint16 `json:"blocked_outgoing_ports,omitempty"`
 	*/
-	Gateways    []string `json:"gateways,omitempty"`
-	Interface   string   `json:"interface,omitempty"`
-	IPAddresses []string `json:"ips,omitempty"`
-	IPAddress   string   `json:"ip,omitempty"`
-	/*
-		HardwareAddress       string   `json:"mac,omitempty"`
-	*/
-	Model        string `json:"model,omitempty"`
-	Tag          string `json:"nic_tag,omitempty"`
-	IsPrimary    *bool  `json:"primary,omitempty"`
-	VirtualLANID uint16 `json:"vlan_id,omitempty"`
+	Gateways        []string `json:"gateways,omitempty"`
+	Interface       string   `json:"interface,omitempty"`
+	IPAddresses     []string `json:"ips,omitempty"`
+	IPAddress       string   `json:"ip,omitempty"`
+	Netmask         string   `json:"netmask,omitempty"`
+	HardwareAddress string   `json:"mac,omitempty"`
+	Model           string   `json:"model,omitempty"`
+	Tag             string   `json:"nic_tag,omitempty"`
+	IsPrimary       *bool    `json:"primary,omitempty"`
+	VirtualLANID    uint16   `json:"vlan_id,omitempty"`
 
 	/*
 		VRRP Support
@@ -288,7 +557,19 @@ func getNetworkInterfaces(d interface{}) ([]NetworkInterface, error) {
 			vrrpPrimaryIP = m
 		}
 
+		mac := ""
+		if m, ok := networkInterfaceDefinition["mac"].(string); ok {
+			mac = m
+		}
+
+		var isPrimary *bool
+		if primary, ok := networkInterfaceDefinition["primary"].(bool); ok && primary {
+			isPrimary = newBool(true)
+		}
+
 		networkInterface := NetworkInterface{
+			HardwareAddress:        mac,
+			IsPrimary:              isPrimary,
 			AllowRestrictedTraffic: allowRestrictedTraffic,
 			AllowIPSpoofing:        allowIPSpoofing,
 			AllowMACSpoofing:       allowMACSpoofing,
@@ -308,13 +589,159 @@ func getNetworkInterfaces(d interface{}) ([]NetworkInterface, error) {
 	return networkInterfaces, nil
 }
 
+// networkInterfacesToSchema converts network interfaces reported by vmadm to the nics
+// schema.
+func networkInterfacesToSchema(networkInterfaces []NetworkInterface) []interface{} {
+	var definitions []interface{}
+
+	for _, networkInterface := range networkInterfaces {
+		ips := networkInterface.IPAddresses
+		if len(ips) == 0 && networkInterface.IPAddress != "" {
+			// Older platforms only report a single address with its netmask.
+			ips = []string{networkInterface.IPAddress}
+			if mask := net.ParseIP(networkInterface.Netmask).To4(); mask != nil {
+				prefixLength, _ := net.IPMask(mask).Size()
+				ips[0] = fmt.Sprintf("%s/%d", networkInterface.IPAddress, prefixLength)
+			}
+		}
+
+		gateways := networkInterface.Gateways
+		if gateways == nil {
+			gateways = []string{}
+		}
+
+		definitions = append(definitions, map[string]interface{}{
+			"allow_restricted_traffic": networkInterface.AllowRestrictedTraffic,
+			"allow_ip_spoofing":        networkInterface.AllowIPSpoofing,
+			"allow_mac_spoofing":       networkInterface.AllowMACSpoofing,
+			"gateways":                 gateways,
+			"interface":                networkInterface.Interface,
+			"ips":                      ips,
+			"mac":                      networkInterface.HardwareAddress,
+			"primary":                  boolValue(networkInterface.IsPrimary),
+			"nic_tag":                  networkInterface.Tag,
+			"model":                    networkInterface.Model,
+			"vlan_id":                  int(networkInterface.VirtualLANID),
+			"vrrp_vrid":                uint32Value(networkInterface.VRRPVRID),
+			"vrrp_primary_ip":          networkInterface.VRRPPrimaryIP,
+		})
+	}
+
+	return definitions
+}
+
+// updatableNetworkInterfaceProperties lists the nics properties vmadm changes in place with
+// update_nics.
+var updatableNetworkInterfaceProperties = []string{
+	"allow_ip_spoofing",
+	"allow_mac_spoofing",
+	"allow_restricted_traffic",
+	"gateways",
+	"ips",
+	"model",
+	"nic_tag",
+	"vlan_id",
+	"vrrp_primary_ip",
+	"vrrp_vrid",
+}
+
+// reconcileNetworkInterfaces adds the add_nics, update_nics and remove_nics operations that
+// turn the old nics into the new ones to the machine update, and reports whether there are
+// any.
+//
+// NICs are identified by MAC address.  Terraform carries the computed MAC addresses of a list
+// over by position though, so when NICs are inserted or removed a MAC address can end up on
+// a different interface; such NICs are matched by interface name instead.  A NIC given a MAC
+// address that does not exist yet replaces the NIC with the same interface name.
+func (m *Machine) reconcileNetworkInterfaces(oldDefinitions []interface{}, newDefinitions []interface{}) bool {
+	oldByMAC := map[string]map[string]interface{}{}
+	oldByInterface := map[string]map[string]interface{}{}
+	for _, od := range oldDefinitions {
+		oldDefinition := od.(map[string]interface{})
+		oldByMAC[oldDefinition["mac"].(string)] = oldDefinition
+		oldByInterface[oldDefinition["interface"].(string)] = oldDefinition
+	}
+
+	matched := map[string]bool{}
+	changesMade := false
+
+	for _, nd := range newDefinitions {
+		newDefinition := nd.(map[string]interface{})
+		mac := newDefinition["mac"].(string)
+		interfaceName := newDefinition["interface"].(string)
+
+		oldDefinition, ok := oldByMAC[mac]
+		if !ok || oldDefinition["interface"] != interfaceName {
+			oldDefinition = nil
+			if candidate, ok := oldByInterface[interfaceName]; ok && (mac == "" || oldByMAC[mac] != nil) {
+				oldDefinition = candidate
+			}
+		}
+
+		if oldDefinition == nil || matched[oldDefinition["mac"].(string)] {
+			networkInterfaces, _ := getNetworkInterfaces([]interface{}{newDefinition})
+			networkInterface := networkInterfaces[0]
+
+			// Only MAC addresses and primary flags that are not carried over from other NICs
+			// are kept; vmadm moves the primary flag to a NIC added with it.
+			if carried := oldByMAC[mac]; carried != nil {
+				networkInterface.HardwareAddress = ""
+				if carried["primary"] == true {
+					networkInterface.IsPrimary = nil
+				}
+			}
+
+			log.Printf("NICS: Adding %s", interfaceName)
+			m.AddNetworkInterfaces = append(m.AddNetworkInterfaces, networkInterface)
+			changesMade = true
+			continue
+		}
+
+		oldMAC := oldDefinition["mac"].(string)
+		matched[oldMAC] = true
+
+		update := map[string]interface{}{}
+		for _, property := range updatableNetworkInterfaceProperties {
+			if !reflect.DeepEqual(oldDefinition[property], newDefinition[property]) {
+				update[property] = newDefinition[property]
+			}
+		}
+
+		// vmadm moves the primary flag rather than clearing it.
+		if newDefinition["primary"] == true && oldDefinition["primary"] != true {
+			update["primary"] = true
+		}
+
+		if len(update) > 0 {
+			log.Printf("NICS: Updating %s (%s): %v", interfaceName, oldMAC, update)
+			update["mac"] = oldMAC
+			m.UpdateNetworkInterfaces = append(m.UpdateNetworkInterfaces, update)
+			changesMade = true
+		}
+	}
+
+	for _, od := range oldDefinitions {
+		oldMAC := od.(map[string]interface{})["mac"].(string)
+		if !matched[oldMAC] {
+			log.Printf("NICS: Removing %s", oldMAC)
+			m.RemoveNetworkInterfaces = append(m.RemoveNetworkInterfaces, oldMAC)
+			changesMade = true
+		}
+	}
+
+	return changesMade
+}
+
 type Disk struct {
-	Boot        bool       `json:"boot,omitempty"`
-	Compression string     `json:"compression,omitempty"`
-	ImageUUID   *uuid.UUID `json:"image_uuid,omitempty"`
-	ImageSize   uint32     `json:"image_size,omitempty"`
-	Model       string     `json:"model,omitempty"`
-	Size        *uint32    `json:"size,omitempty"`
+	Boot           bool       `json:"boot,omitempty"`
+	Compression    string     `json:"compression,omitempty"`
+	ImageUUID      *uuid.UUID `json:"image_uuid,omitempty"`
+	ImageSize      uint32     `json:"image_size,omitempty"`
+	Model          string     `json:"model,omitempty"`
+	Path           string     `json:"path,omitempty"`
+	PCISlot        string     `json:"pci_slot,omitempty"`
+	Refreservation *uint32    `json:"refreservation,omitempty"`
+	Size           *uint32    `json:"size,omitempty"`
 }
 
 func getDisks(d interface{}) ([]Disk, error) {
@@ -351,6 +778,21 @@ func getDisks(d interface{}) ([]Disk, error) {
 			disk.Model = m.(string)
 		}
 
+		if p, ok := diskDefinition["path"]; ok {
+			disk.Path = p.(string)
+		}
+
+		if ps, ok := diskDefinition["pci_slot"]; ok {
+			disk.PCISlot = ps.(string)
+		}
+
+		if rr, ok := diskDefinition["refreservation"]; ok {
+			refreservation := uint32(rr.(int))
+			if refreservation > 0 {
+				disk.Refreservation = &refreservation
+			}
+		}
+
 		if sz, ok := diskDefinition["size"]; ok {
 			size := uint32(sz.(int))
 			if size > 0 {
@@ -363,3 +805,253 @@ func getDisks(d interface{}) ([]Disk, error) {
 
 	return disks, nil
 }
+
+// disksToSchema converts disks reported by vmadm to the disks schema.
+func disksToSchema(disks []Disk) []interface{} {
+	var definitions []interface{}
+
+	for _, disk := range disks {
+		var imageUUID string
+		if disk.ImageUUID != nil {
+			imageUUID = disk.ImageUUID.String()
+		}
+
+		definitions = append(definitions, map[string]interface{}{
+			"boot":           disk.Boot,
+			"compression":    disk.Compression,
+			"image_uuid":     imageUUID,
+			"image_size":     int(disk.ImageSize),
+			"model":          disk.Model,
+			"path":           disk.Path,
+			"pci_slot":       disk.PCISlot,
+			"refreservation": uint32Value(disk.Refreservation),
+			"size":           uint32Value(disk.Size),
+		})
+	}
+
+	return definitions
+}
+
+// matchDisks returns the index of the old disk each new disk corresponds to, or -1 for new
+// disks.  Disks are matched by path and, when no path is known, by position.
+func matchDisks(oldDefinitions []interface{}, newDefinitions []interface{}) []int {
+	oldByPath := map[string]int{}
+	for i, od := range oldDefinitions {
+		if path := od.(map[string]interface{})["path"].(string); path != "" {
+			oldByPath[path] = i
+		}
+	}
+
+	matches := make([]int, len(newDefinitions))
+	matched := map[int]bool{}
+
+	for i, nd := range newDefinitions {
+		matches[i] = -1
+
+		path := nd.(map[string]interface{})["path"].(string)
+		if oldIndex, ok := oldByPath[path]; ok && !matched[oldIndex] {
+			matches[i] = oldIndex
+		} else if path == "" && i < len(oldDefinitions) && !matched[i] {
+			matches[i] = i
+		}
+
+		if matches[i] >= 0 {
+			matched[matches[i]] = true
+		}
+	}
+
+	return matches
+}
+
+// checkDiskRemovals rejects removing disks while the remaining disks change.  Terraform carries
+// the computed path of a disk that does not set one over by position, so when a disk other
+// than the last is removed, the disks after it take on the paths of the disks before them.
+// Such a plan looks like changes to the remaining disks and the removal of the last one, and
+// would remove a disk that is kept.  Disks that set the path of a disk further down the list
+// are matched by it and may follow a removed disk.
+func checkDiskRemovals(oldDefinitions []interface{}, newDefinitions []interface{}) error {
+	if len(newDefinitions) >= len(oldDefinitions) {
+		return nil
+	}
+
+	for i, oldIndex := range matchDisks(oldDefinitions, newDefinitions) {
+		if oldIndex != i {
+			continue
+		}
+
+		oldDefinition := oldDefinitions[oldIndex].(map[string]interface{})
+		newDefinition := newDefinitions[i].(map[string]interface{})
+
+		for _, property := range append([]string{"image_uuid"}, updatableDiskProperties...) {
+			newValue := newDefinition[property]
+			if newValue == "" || newValue == 0 {
+				continue
+			}
+
+			if !reflect.DeepEqual(oldDefinition[property], newValue) {
+				return fmt.Errorf("disks.%d: cannot change disk %s while disks are removed; only remove disks from the end of the list, or set path on the disks after a removed one", i, oldDefinition["path"])
+			}
+		}
+	}
+
+	return nil
+}
+
+// updatableDiskProperties lists the disks properties vmadm changes in place with update_disks.
+var updatableDiskProperties = []string{
+	"boot",
+	"compression",
+	"model",
+	"pci_slot",
+	"refreservation",
+	"size",
+}
+
+// reconcileDisks adds the add_disks, update_disks and remove_disks operations that turn the old
+// disks into the new ones to the machine update, and reports whether there are any.
+func (m *Machine) reconcileDisks(oldDefinitions []interface{}, newDefinitions []interface{}) bool {
+	matches := matchDisks(oldDefinitions, newDefinitions)
+	matched := map[int]bool{}
+	changesMade := false
+
+	for i, nd := range newDefinitions {
+		newDefinition := nd.(map[string]interface{})
+
+		if matches[i] < 0 {
+			disks, _ := getDisks([]interface{}{newDefinition})
+
+			log.Printf("DISKS: Adding disk %d", i)
+			m.AddDisks = append(m.AddDisks, disks[0])
+			changesMade = true
+			continue
+		}
+
+		matched[matches[i]] = true
+		oldDefinition := oldDefinitions[matches[i]].(map[string]interface{})
+
+		update := map[string]interface{}{}
+		for _, property := range updatableDiskProperties {
+			newValue := newDefinition[property]
+
+			// Computed properties that are not configured keep their value.
+			if newValue == "" || newValue == 0 {
+				continue
+			}
+
+			if !reflect.DeepEqual(oldDefinition[property], newValue) {
+				update[property] = newValue
+			}
+		}
+
+		if len(update) > 0 {
+			path := oldDefinition["path"].(string)
+			log.Printf("DISKS: Updating %s: %v", path, update)
+			update["path"] = path
+			m.UpdateDisks = append(m.UpdateDisks, update)
+			changesMade = true
+		}
+	}
+
+	for i, od := range oldDefinitions {
+		if !matched[i] {
+			path := od.(map[string]interface{})["path"].(string)
+			log.Printf("DISKS: Removing %s", path)
+			m.RemoveDisks = append(m.RemoveDisks, path)
+			changesMade = true
+		}
+	}
+
+	return changesMade
+}
+
+type Filesystem struct {
+	Source  string   `json:"source"`
+	Target  string   `json:"target"`
+	Type    string   `json:"type"`
+	Options []string `json:"options,omitempty"`
+}
+
+func getFilesystems(d interface{}) []Filesystem {
+	var filesystems []Filesystem
+
+	for _, fd := range d.([]interface{}) {
+		filesystemDefinition := fd.(map[string]interface{})
+
+		var options []string
+		for _, option := range filesystemDefinition["options"].([]interface{}) {
+			options = append(options, option.(string))
+		}
+
+		filesystems = append(filesystems, Filesystem{
+			Source:  filesystemDefinition["source"].(string),
+			Target:  filesystemDefinition["target"].(string),
+			Type:    filesystemDefinition["type"].(string),
+			Options: options,
+		})
+	}
+
+	return filesystems
+}
+
+// filesystemsToSchema converts filesystems reported by vmadm to the filesystems schema.
+func filesystemsToSchema(filesystems []Filesystem) []interface{} {
+	var definitions []interface{}
+
+	for _, filesystem := range filesystems {
+		options := filesystem.Options
+		if options == nil {
+			options = []string{}
+		}
+
+		definitions = append(definitions, map[string]interface{}{
+			"source":  filesystem.Source,
+			"target":  filesystem.Target,
+			"type":    filesystem.Type,
+			"options": options,
+		})
+	}
+
+	return definitions
+}
+
+// reconcileFilesystems adds the add_filesystems and remove_filesystems operations that turn
+// the old filesystems into the new ones to the machine update, and reports whether there are
+// any.
+//
+// Filesystems are identified by their target.  vmadm cannot change a filesystem in place, so a
+// changed filesystem is removed and added again.
+func (m *Machine) reconcileFilesystems(oldDefinitions []interface{}, newDefinitions []interface{}) bool {
+	oldByTarget := map[string]map[string]interface{}{}
+	for _, od := range oldDefinitions {
+		oldDefinition := od.(map[string]interface{})
+		oldByTarget[oldDefinition["target"].(string)] = oldDefinition
+	}
+
+	kept := map[string]bool{}
+	changesMade := false
+
+	for _, nd := range newDefinitions {
+		newDefinition := nd.(map[string]interface{})
+		target := newDefinition["target"].(string)
+
+		if oldDefinition, ok := oldByTarget[target]; ok && reflect.DeepEqual(oldDefinition, newDefinition) {
+			kept[target] = true
+			continue
+		}
+
+		log.Printf("FILESYSTEMS: Adding %s", target)
+		m.AddFilesystems = append(m.AddFilesystems, getFilesystems([]interface{}{newDefinition})...)
+		changesMade = true
+	}
+
+	for _, od := range oldDefinitions {
+		target := od.(map[string]interface{})["target"].(string)
+		if !kept[target] {
+			log.Printf("FILESYSTEMS: Removing %s", target)
+			m.RemoveFilesystems = append(m.RemoveFilesystems, target)
+			changesMade = true
+		}
+	}
+
+	return changesMade
+}
@@ -0,0 +1,101 @@
+package smartos
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/resource"
+)
+
+// readinessDialTimeout bounds each attempt to connect to the port of a machine that is being
+// waited for.
+const readinessDialTimeout = 5 * time.Second
+
+// ReadinessGates are the conditions a new machine has to meet before it is considered
+// created.
+type ReadinessGates struct {
+	Running  bool
+	Port     int
+	Metadata []string
+}
+
+func (g *ReadinessGates) empty() bool {
+	return !g.Running && g.Port == 0 && len(g.Metadata) == 0
+}
+
+// checkMachineReady returns a description of the first gate the machine does not meet yet, or
+// "" when it meets them all.
+func (g *ReadinessGates) checkMachineReady(ctx context.Context, machine *Machine) string {
+	if g.Running && machine.State != "running" {
+		return fmt.Sprintf("state is %s, waiting for running", machine.State)
+	}
+
+	var missing []string
+	for _, key := range g.Metadata {
+		if _, ok := machine.Metadata[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Sprintf("waiting for the guest to publish metadata %s", strings.Join(missing, ", "))
+	}
+
+	if g.Port > 0 {
+		address := net.JoinHostPort(machine.PrimaryIP, strconv.Itoa(g.Port))
+		dialer := net.Dialer{Timeout: readinessDialTimeout}
+		conn, err := dialer.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return fmt.Sprintf("waiting for port %s (%s)", address, err)
+		}
+		conn.Close()
+	}
+
+	return ""
+}
+
+// waitForMachineReady polls the machine until it meets the readiness gates or the context is
+// done.
+func (c *SmartOSClient) waitForMachineReady(ctx context.Context, nodeName string, id uuid.UUID, gates *ReadinessGates) error {
+	if gates.empty() {
+		return nil
+	}
+
+	timeout := time.Duration(math.MaxInt64)
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+
+	log.Printf("Waiting up to %s for machine %s to become ready", timeout, id.String())
+
+	var notReady error
+	return resource.RetryContext(ctx, timeout, func() *resource.RetryError {
+		machine, err := c.GetMachine(ctx, nodeName, id)
+		if err != nil {
+			// The timeout most likely expired while the machine was read.
+			if ctx.Err() != nil && notReady != nil {
+				return resource.NonRetryableError(notReady)
+			}
+			return resource.NonRetryableError(err)
+		}
+
+		if gates.Port > 0 && machine.PrimaryIP == "" {
+			return resource.NonRetryableError(fmt.Errorf("machine %s has no primary IP address to wait for port %d on; the primary NIC needs a static IP address", id.String(), gates.Port))
+		}
+
+		if reason := gates.checkMachineReady(ctx, machine); reason != "" {
+			log.Printf("Machine %s is not ready: %s", id.String(), reason)
+			notReady = fmt.Errorf("machine %s did not become ready before the create timeout: %s", id.String(), reason)
+			return resource.RetryableError(notReady)
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,132 @@
+package smartos
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadinessGates_checkMachineReady(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	openPort := listener.Addr().(*net.TCPAddr).Port
+
+	// A port nothing listens on any more.
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := closed.Addr().(*net.TCPAddr).Port
+	closed.Close()
+
+	running := &Machine{State: "running", PrimaryIP: "127.0.0.1", Metadata: map[string]string{"ready": "true"}}
+
+	for _, tc := range []struct {
+		name    string
+		gates   ReadinessGates
+		machine *Machine
+		reason  string
+	}{
+		{
+			name:    "no gates",
+			machine: &Machine{State: "provisioning"},
+		},
+		{
+			name:    "not running",
+			gates:   ReadinessGates{Running: true},
+			machine: &Machine{State: "provisioning"},
+			reason:  "state is provisioning, waiting for running",
+		},
+		{
+			name:    "missing metadata",
+			gates:   ReadinessGates{Metadata: []string{"ready", "ssh", "web"}},
+			machine: &Machine{State: "running", Metadata: map[string]string{"ssh": "up"}},
+			reason:  "waiting for the guest to publish metadata ready, web",
+		},
+		{
+			name:    "closed port",
+			gates:   ReadinessGates{Port: closedPort},
+			machine: running,
+			reason:  "waiting for port 127.0.0.1:",
+		},
+		{
+			name:    "ready",
+			gates:   ReadinessGates{Running: true, Port: openPort, Metadata: []string{"ready"}},
+			machine: running,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			reason := tc.gates.checkMachineReady(context.Background(), tc.machine)
+
+			if (tc.reason == "" && reason != "") || !strings.HasPrefix(reason, tc.reason) {
+				t.Errorf("reason = %q, want %q", reason, tc.reason)
+			}
+		})
+	}
+}
+
+func TestClient_waitForMachineReady(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+	f.AddInstalledImage(testImage)
+
+	client := testClient(t, f, nil)
+	defer client.Close()
+
+	gates := &ReadinessGates{Running: true, Metadata: []string{"ready"}}
+
+	t.Run("ready", func(t *testing.T) {
+		f.SimulateBoot(200*time.Millisecond, map[string]string{"terraform:ready": "true"})
+
+		id, err := client.CreateMachine(context.Background(), "node1", testMachine("node1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		if err := client.waitForMachineReady(ctx, "node1", *id, gates); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		f.SimulateBoot(time.Minute, nil)
+
+		id, err := client.CreateMachine(context.Background(), "node1", testMachine("node1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		err = client.waitForMachineReady(ctx, "node1", *id, gates)
+		if err == nil || !strings.Contains(err.Error(), "did not become ready before the create timeout: state is provisioning, waiting for running") {
+			t.Errorf("error = %v, want a timeout naming the state", err)
+		}
+	})
+
+	t.Run("port without primary IP", func(t *testing.T) {
+		f.SimulateBoot(0, nil)
+
+		machine := testMachine("node1")
+		machine.NetworkInterfaces[0].IPAddresses = []string{"dhcp"}
+
+		id, err := client.CreateMachine(context.Background(), "node1", machine)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = client.waitForMachineReady(context.Background(), "node1", *id, &ReadinessGates{Port: 22})
+		if err == nil || !strings.Contains(err.Error(), "has no primary IP address to wait for port 22") {
+			t.Errorf("error = %v, want one about the missing primary IP address", err)
+		}
+	})
+}
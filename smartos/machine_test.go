@@ -0,0 +1,306 @@
+package smartos
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testNIC(interfaceName string, mac string, ips ...string) map[string]interface{} {
+	var ipList []interface{}
+	for _, ip := range ips {
+		ipList = append(ipList, ip)
+	}
+
+	return map[string]interface{}{
+		"allow_restricted_traffic": false,
+		"allow_ip_spoofing":        false,
+		"allow_mac_spoofing":       false,
+		"gateways":                 []interface{}{},
+		"interface":                interfaceName,
+		"ips":                      ipList,
+		"mac":                      mac,
+		"nic_tag":                  "admin",
+		"model":                    "",
+		"primary":                  interfaceName == "net0",
+		"vlan_id":                  0,
+		"vrrp_vrid":                0,
+		"vrrp_primary_ip":          "",
+	}
+}
+
+func TestReconcileNetworkInterfaces(t *testing.T) {
+	old := []interface{}{
+		testNIC("net0", "90:b8:d0:00:00:01", "10.0.0.10/24"),
+		testNIC("net1", "90:b8:d0:00:00:02", "10.0.1.10/24"),
+	}
+
+	t.Run("unchanged", func(t *testing.T) {
+		var m Machine
+		if m.reconcileNetworkInterfaces(old, old) {
+			t.Errorf("unexpected changes: %+v", m)
+		}
+	})
+
+	t.Run("update", func(t *testing.T) {
+		changed := testNIC("net1", "90:b8:d0:00:00:02", "10.0.1.11/24")
+		changed["gateways"] = []interface{}{"10.0.1.1"}
+
+		var m Machine
+		m.reconcileNetworkInterfaces(old, []interface{}{old[0], changed})
+
+		want := []map[string]interface{}{{
+			"mac":      "90:b8:d0:00:00:02",
+			"ips":      []interface{}{"10.0.1.11/24"},
+			"gateways": []interface{}{"10.0.1.1"},
+		}}
+		if !reflect.DeepEqual(m.UpdateNetworkInterfaces, want) {
+			t.Errorf("update_nics = %v, want %v", m.UpdateNetworkInterfaces, want)
+		}
+
+		if len(m.AddNetworkInterfaces) != 0 || len(m.RemoveNetworkInterfaces) != 0 {
+			t.Errorf("unexpected add_nics %v or remove_nics %v", m.AddNetworkInterfaces, m.RemoveNetworkInterfaces)
+		}
+	})
+
+	t.Run("insert at front", func(t *testing.T) {
+		// The MAC addresses stay at their list positions in the plan.
+		inserted := testNIC("net2", "90:b8:d0:00:00:01", "10.0.2.10/24")
+		inserted["primary"] = true
+		net0 := testNIC("net0", "90:b8:d0:00:00:02", "10.0.0.10/24")
+		net0["primary"] = false
+		net1 := testNIC("net1", "", "10.0.1.10/24")
+		net1["primary"] = false
+
+		var m Machine
+		m.reconcileNetworkInterfaces(old, []interface{}{inserted, net0, net1})
+
+		if len(m.AddNetworkInterfaces) != 1 || m.AddNetworkInterfaces[0].Interface != "net2" {
+			t.Fatalf("add_nics = %+v, want net2", m.AddNetworkInterfaces)
+		}
+
+		if mac := m.AddNetworkInterfaces[0].HardwareAddress; mac != "" {
+			t.Errorf("added NIC took over MAC address %s", mac)
+		}
+
+		if m.AddNetworkInterfaces[0].IsPrimary != nil {
+			t.Errorf("added NIC took over the primary flag")
+		}
+
+		if len(m.UpdateNetworkInterfaces) != 0 || len(m.RemoveNetworkInterfaces) != 0 {
+			t.Errorf("unexpected update_nics %v or remove_nics %v", m.UpdateNetworkInterfaces, m.RemoveNetworkInterfaces)
+		}
+	})
+
+	t.Run("add primary", func(t *testing.T) {
+		added := testNIC("net2", "", "10.0.2.10/24")
+		added["primary"] = true
+
+		var m Machine
+		m.reconcileNetworkInterfaces(old, []interface{}{old[0], old[1], added})
+
+		if len(m.AddNetworkInterfaces) != 1 || !boolValue(m.AddNetworkInterfaces[0].IsPrimary) {
+			t.Errorf("add_nics = %+v, want net2 as primary", m.AddNetworkInterfaces)
+		}
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		net1 := testNIC("net1", "90:b8:d0:00:00:01", "10.0.1.10/24")
+		net1["primary"] = true
+
+		var m Machine
+		m.reconcileNetworkInterfaces(old, []interface{}{net1})
+
+		if !reflect.DeepEqual(m.RemoveNetworkInterfaces, []string{"90:b8:d0:00:00:01"}) {
+			t.Errorf("remove_nics = %v, want net0's MAC address", m.RemoveNetworkInterfaces)
+		}
+
+		want := []map[string]interface{}{{"mac": "90:b8:d0:00:00:02", "primary": true}}
+		if !reflect.DeepEqual(m.UpdateNetworkInterfaces, want) {
+			t.Errorf("update_nics = %v, want %v", m.UpdateNetworkInterfaces, want)
+		}
+	})
+
+	t.Run("replace by MAC address", func(t *testing.T) {
+		replaced := testNIC("net1", "90:b8:d0:00:00:99", "10.0.1.10/24")
+
+		var m Machine
+		m.reconcileNetworkInterfaces(old, []interface{}{old[0], replaced})
+
+		if len(m.AddNetworkInterfaces) != 1 || m.AddNetworkInterfaces[0].HardwareAddress != "90:b8:d0:00:00:99" {
+			t.Errorf("add_nics = %+v, want the new MAC address", m.AddNetworkInterfaces)
+		}
+
+		if !reflect.DeepEqual(m.RemoveNetworkInterfaces, []string{"90:b8:d0:00:00:02"}) {
+			t.Errorf("remove_nics = %v, want the old MAC address", m.RemoveNetworkInterfaces)
+		}
+	})
+}
+
+func testDisk(path string, size int) map[string]interface{} {
+	return map[string]interface{}{
+		"boot":        false,
+		"compression": "off",
+		"image_uuid":  "",
+		"image_size":  0,
+		"model":       "virtio",
+		"path":        path,
+		"size":        size,
+	}
+}
+
+func TestReconcileDisks(t *testing.T) {
+	old := []interface{}{
+		testDisk("/dev/zvol/rdsk/zones/test/disk0", 10240),
+		testDisk("/dev/zvol/rdsk/zones/test/disk1", 20480),
+	}
+
+	t.Run("unchanged", func(t *testing.T) {
+		var m Machine
+		if m.reconcileDisks(old, old) {
+			t.Errorf("unexpected changes: %+v", m)
+		}
+	})
+
+	t.Run("grow", func(t *testing.T) {
+		var m Machine
+		m.reconcileDisks(old, []interface{}{old[0], testDisk("/dev/zvol/rdsk/zones/test/disk1", 40960)})
+
+		want := []map[string]interface{}{{"path": "/dev/zvol/rdsk/zones/test/disk1", "size": 40960}}
+		if !reflect.DeepEqual(m.UpdateDisks, want) {
+			t.Errorf("update_disks = %v, want %v", m.UpdateDisks, want)
+		}
+	})
+
+	t.Run("unset computed properties", func(t *testing.T) {
+		disk := testDisk("/dev/zvol/rdsk/zones/test/disk1", 0)
+		disk["compression"] = ""
+
+		var m Machine
+		if m.reconcileDisks(old, []interface{}{old[0], disk}) {
+			t.Errorf("unexpected changes: %+v", m)
+		}
+	})
+
+	t.Run("add", func(t *testing.T) {
+		var m Machine
+		m.reconcileDisks(old, []interface{}{old[0], old[1], testDisk("", 5120)})
+
+		if len(m.AddDisks) != 1 || m.AddDisks[0].Size == nil || *m.AddDisks[0].Size != 5120 {
+			t.Errorf("add_disks = %+v, want one 5120 MiB disk", m.AddDisks)
+		}
+
+		if len(m.UpdateDisks) != 0 || len(m.RemoveDisks) != 0 {
+			t.Errorf("unexpected update_disks %v or remove_disks %v", m.UpdateDisks, m.RemoveDisks)
+		}
+	})
+
+	t.Run("remove by set path", func(t *testing.T) {
+		// The remaining disk sets the path of the second disk.
+		if err := checkDiskRemovals(old, []interface{}{old[1]}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		var m Machine
+		m.reconcileDisks(old, []interface{}{old[1]})
+
+		if !reflect.DeepEqual(m.RemoveDisks, []string{"/dev/zvol/rdsk/zones/test/disk0"}) {
+			t.Errorf("remove_disks = %v, want disk0", m.RemoveDisks)
+		}
+
+		if len(m.UpdateDisks) != 0 {
+			t.Errorf("unexpected update_disks %v", m.UpdateDisks)
+		}
+	})
+
+	t.Run("match by position", func(t *testing.T) {
+		var m Machine
+		m.reconcileDisks(old, []interface{}{old[0], testDisk("", 30720)})
+
+		want := []map[string]interface{}{{"path": "/dev/zvol/rdsk/zones/test/disk1", "size": 30720}}
+		if !reflect.DeepEqual(m.UpdateDisks, want) {
+			t.Errorf("update_disks = %v, want %v", m.UpdateDisks, want)
+		}
+
+		if len(m.AddDisks) != 0 || len(m.RemoveDisks) != 0 {
+			t.Errorf("unexpected add_disks %v or remove_disks %v", m.AddDisks, m.RemoveDisks)
+		}
+	})
+
+	t.Run("position-carried paths", func(t *testing.T) {
+		old := append(old, testDisk("/dev/zvol/rdsk/zones/test/disk2", 40960))
+
+		// Removing the second disk without setting paths leaves the third disk's configuration
+		// at index 1, where it takes on the path of the removed disk.
+		carried := testDisk("/dev/zvol/rdsk/zones/test/disk1", 40960)
+
+		if err := checkDiskRemovals(old, []interface{}{old[0], carried}); err == nil || !strings.Contains(err.Error(), "disks.1: cannot change disk /dev/zvol/rdsk/zones/test/disk1 while disks are removed") {
+			t.Errorf("error = %v, want disks.1 rejected", err)
+		}
+
+		// The reverse order would otherwise be reported as shrinking the second disk.
+		reversed := []interface{}{old[0], old[2], old[1]}
+		carried = testDisk("/dev/zvol/rdsk/zones/test/disk2", 20480)
+
+		if err := checkDiskRemovals(reversed, []interface{}{reversed[0], carried}); err == nil || !strings.Contains(err.Error(), "while disks are removed") {
+			t.Errorf("error = %v, want disks.1 rejected", err)
+		}
+
+		// Removing the last disk carries every path over unchanged.
+		if err := checkDiskRemovals(old, []interface{}{old[0], old[1]}); err != nil {
+			t.Errorf("unexpected error removing the last disk: %v", err)
+		}
+
+		var m Machine
+		m.reconcileDisks(old, []interface{}{old[0], old[1]})
+
+		if !reflect.DeepEqual(m.RemoveDisks, []string{"/dev/zvol/rdsk/zones/test/disk2"}) || len(m.UpdateDisks) != 0 {
+			t.Errorf("remove_disks = %v, update_disks = %v, want only disk2 removed", m.RemoveDisks, m.UpdateDisks)
+		}
+	})
+}
+
+func testFilesystem(source string, target string, options ...interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"source":  source,
+		"target":  target,
+		"type":    "lofs",
+		"options": options,
+	}
+}
+
+func TestReconcileFilesystems(t *testing.T) {
+	old := []interface{}{
+		testFilesystem("/zones/shared/data", "/data"),
+		testFilesystem("/zones/shared/logs", "/logs", "ro"),
+	}
+
+	t.Run("unchanged", func(t *testing.T) {
+		var m Machine
+		if m.reconcileFilesystems(old, old) {
+			t.Errorf("unexpected changes: %+v", m)
+		}
+	})
+
+	t.Run("changed, added and removed", func(t *testing.T) {
+		var m Machine
+		m.reconcileFilesystems(old, []interface{}{
+			testFilesystem("/zones/shared/data", "/data", "nodevice"),
+			testFilesystem("/zones/shared/cache", "/cache"),
+		})
+
+		var added []string
+		for _, filesystem := range m.AddFilesystems {
+			added = append(added, filesystem.Target)
+		}
+
+		// A changed filesystem is removed and mounted again.
+		if !reflect.DeepEqual(added, []string{"/data", "/cache"}) || !reflect.DeepEqual(m.AddFilesystems[0].Options, []string{"nodevice"}) {
+			t.Errorf("add_filesystems = %+v, want /data with nodevice and /cache", m.AddFilesystems)
+		}
+
+		if !reflect.DeepEqual(m.RemoveFilesystems, []string{"/data", "/logs"}) {
+			t.Errorf("remove_filesystems = %v, want /data and /logs", m.RemoveFilesystems)
+		}
+	})
+}
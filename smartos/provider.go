@@ -1,12 +1,13 @@
 package smartos
 
 import (
-	"net"
-	"os"
+	"fmt"
+	"sync"
+	"time"
 
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
 	"golang.org/x/crypto/ssh"
-	"golang.org/x/crypto/ssh/agent"
 )
 
 func Provider() *schema.Provider {
@@ -23,21 +24,149 @@ func Provider() *schema.Provider {
 func providerSchema() map[string]*schema.Schema {
 	return map[string]*schema.Schema{
 		"hosts": {
-			Type:        schema.TypeMap,
-			Required:    true,
-			Description: "Host addresses of the SmartOS global zone.",
+			Type:         schema.TypeMap,
+			Optional:     true,
+			Elem:         &schema.Schema{Type: schema.TypeString},
+			AtLeastOneOf: []string{"hosts", "host"},
+			Description:  "Host addresses of the SmartOS global zones, keyed by node name.  An address may include a port as address:port.",
+		},
+		"host": {
+			Type:         schema.TypeList,
+			Optional:     true,
+			Elem:         hostSchema(),
+			AtLeastOneOf: []string{"hosts", "host"},
+			Description:  "SmartOS global zone with its own connection settings.",
+		},
+		"bastion": {
+			Type:        schema.TypeList,
+			Optional:    true,
+			Elem:        bastionSchema(),
+			Description: "Jump hosts the global zones are reached through, outermost first.  Multiple blocks form a chain like OpenSSH's ProxyJump.",
+		},
+		"port": {
+			Type:        schema.TypeInt,
+			Optional:    true,
+			Default:     22,
+			Description: "SSH port of the global zones.",
 		},
 		"user": {
 			Type:        schema.TypeString,
-			Required:    true,
+			Optional:    true,
+			Default:     "root",
 			Description: "User to authenticate with.",
 		},
+		"private_key": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Sensitive:   true,
+			DefaultFunc: schema.EnvDefaultFunc("SMARTOS_PRIVATE_KEY", nil),
+			Description: "PEM or OpenSSH encoded private key to authenticate with.",
+		},
+		"private_key_file": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			DefaultFunc: schema.EnvDefaultFunc("SMARTOS_PRIVATE_KEY_FILE", nil),
+			Description: "Path of a private key file to authenticate with.",
+		},
+		"private_key_passphrase": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Sensitive:   true,
+			DefaultFunc: schema.EnvDefaultFunc("SMARTOS_PRIVATE_KEY_PASSPHRASE", nil),
+			Description: "Passphrase used to decrypt `private_key` or `private_key_file`.",
+		},
+		"certificate": {
+			Type:          schema.TypeString,
+			Optional:      true,
+			ConflictsWith: []string{"certificate_file"},
+			Description:   "OpenSSH user certificate signing `private_key` or `private_key_file`.",
+		},
+		"certificate_file": {
+			Type:          schema.TypeString,
+			Optional:      true,
+			ConflictsWith: []string{"certificate"},
+			Description:   "Path of an OpenSSH user certificate signing `private_key` or `private_key_file`.",
+		},
+		"password": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Sensitive:   true,
+			DefaultFunc: schema.EnvDefaultFunc("SMARTOS_PASSWORD", nil),
+			Description: "Password used for password and keyboard-interactive authentication.",
+		},
+		"known_hosts_file": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Default:     "~/.ssh/known_hosts",
+			Description: "OpenSSH known_hosts file used to verify the host keys of the global zones.",
+		},
+		"host_key_fingerprints": {
+			Type:        schema.TypeMap,
+			Optional:    true,
+			Elem:        &schema.Schema{Type: schema.TypeString},
+			Description: "Pinned host keys of the global zones, keyed by node name.  Values may be SHA256 fingerprints as printed by `ssh-keygen -l` or public keys in authorized_keys format.",
+		},
+		"trust_on_first_use": {
+			Type:        schema.TypeBool,
+			Optional:    true,
+			Default:     false,
+			Description: "Trust the host key of a node that is not yet known and record it in `managed_known_hosts_file`.",
+		},
+		"max_sessions": {
+			Type:         schema.TypeInt,
+			Optional:     true,
+			Default:      10,
+			ValidateFunc: validation.IntAtLeast(0),
+			Description:  "Maximum number of concurrent SSH sessions per node.  Operations over the limit wait for a free session.  0 is unlimited.",
+		},
+		"max_concurrent_provisions": {
+			Type:         schema.TypeInt,
+			Optional:     true,
+			Default:      0,
+			ValidateFunc: validation.IntAtLeast(0),
+			Description:  "Maximum number of concurrent `vmadm create` and `imgadm import` operations per node.  Operations over the limit wait their turn.  0 is unlimited.",
+		},
+		"max_retries": {
+			Type:         schema.TypeInt,
+			Optional:     true,
+			Default:      3,
+			ValidateFunc: validation.IntAtLeast(0),
+			Description:  "Number of times an operation that failed for a transient reason, such as a dropped connection or a busy zone, is retried.",
+		},
+		"retry_initial_backoff": {
+			Type:         schema.TypeInt,
+			Optional:     true,
+			Default:      1,
+			ValidateFunc: validation.IntAtLeast(0),
+			Description:  "Seconds to wait before the first retry.  The delay doubles with every retry and is randomized to spread out parallel retries.",
+		},
+		"retry_max_backoff": {
+			Type:         schema.TypeInt,
+			Optional:     true,
+			Default:      30,
+			ValidateFunc: validation.IntAtLeast(0),
+			Description:  "Maximum number of seconds to wait between retries.",
+		},
+		"keepalive_interval": {
+			Type:         schema.TypeInt,
+			Optional:     true,
+			Default:      30,
+			ValidateFunc: validation.IntAtLeast(0),
+			Description:  "Seconds between SSH keepalives used to detect dead connections to the global zones.  0 disables keepalives.",
+		},
+		"managed_known_hosts_file": {
+			Type:        schema.TypeString,
+			Optional:    true,
+			Default:     "~/.terraform.d/smartos_known_hosts",
+			Description: "known_hosts file maintained by the provider for hosts trusted on first use.",
+		},
 	}
 }
 
 func providerResources() map[string]*schema.Resource {
 	return map[string]*schema.Resource{
-		"smartos_machine": resourceMachine(),
+		"smartos_firewall_rule": resourceFirewallRule(),
+		"smartos_machine":       resourceMachine(),
 	}
 }
 
@@ -48,22 +177,119 @@ func providerDataSources() map[string]*schema.Resource {
 }
 
 func providerConfigure(d *schema.ResourceData) (interface{}, error) {
-	sshSocket := os.Getenv("SSH_AUTH_SOCK")
-	agentConnection, err := net.Dial("unix", sshSocket)
+	defaults := Host{
+		Port:                    d.Get("port").(int),
+		User:                    d.Get("user").(string),
+		MaxSessions:             d.Get("max_sessions").(int),
+		MaxConcurrentProvisions: d.Get("max_concurrent_provisions").(int),
+		Credentials: Credentials{
+			PrivateKey:           d.Get("private_key").(string),
+			PrivateKeyFile:       d.Get("private_key_file").(string),
+			PrivateKeyPassphrase: d.Get("private_key_passphrase").(string),
+			Password:             d.Get("password").(string),
+			Certificate:          d.Get("certificate").(string),
+			CertificateFile:      d.Get("certificate_file").(string),
+		},
+	}
+
+	defaults.Bastions = getBastions(d.Get("bastion").([]interface{}), defaults)
+
+	hosts, err := getHosts(d, defaults)
 	if err != nil {
 		return nil, err
 	}
 
-	authMethods := []ssh.AuthMethod{}
-	authMethods = append(authMethods, ssh.PublicKeysCallback(agent.NewClient(agentConnection).Signers))
+	for nodeName, fingerprint := range d.Get("host_key_fingerprints").(map[string]interface{}) {
+		host, ok := hosts[nodeName]
+		if !ok {
+			return nil, fmt.Errorf("host_key_fingerprints refers to unknown host %s", nodeName)
+		}
+
+		if host.HostKey == "" {
+			host.HostKey = fingerprint.(string)
+		}
+	}
+
+	agentConnection, agentClient := connectAgent()
+
+	var agentSigners func() ([]ssh.Signer, error)
+	if agentClient != nil {
+		agentSigners = agentClient.Signers
+	}
+
+	for nodeName, host := range hosts {
+		if host.Executor != "ssh" {
+			continue
+		}
+
+		for _, hop := range append(append([]*Host{}, host.Bastions...), host) {
+			hop.authMethods, err = hop.Credentials.AuthMethods(agentSigners)
+			if err != nil {
+				if agentConnection != nil {
+					agentConnection.Close()
+				}
+				if hop != host {
+					return nil, fmt.Errorf("host %s, %s: %s", nodeName, hop.Name, err)
+				}
+				return nil, fmt.Errorf("host %s: %s", nodeName, err)
+			}
+		}
+	}
+
+	hostKeyVerifier := HostKeyVerifier{
+		KnownHostsFile:        d.Get("known_hosts_file").(string),
+		ManagedKnownHostsFile: d.Get("managed_known_hosts_file").(string),
+		TrustOnFirstUse:       d.Get("trust_on_first_use").(bool),
+	}
+
+	keepaliveInterval := time.Duration(d.Get("keepalive_interval").(int)) * time.Second
+
+	retryPolicy := RetryPolicy{
+		MaxRetries:     d.Get("max_retries").(int),
+		InitialBackoff: time.Duration(d.Get("retry_initial_backoff").(int)) * time.Second,
+		MaxBackoff:     time.Duration(d.Get("retry_max_backoff").(int)) * time.Second,
+	}
+
+	pool := NewConnectionPool(hosts, &hostKeyVerifier, keepaliveInterval)
+
+	executors := map[string]Executor{}
+	for nodeName, host := range hosts {
+		if host.Executor == "local" {
+			executors[nodeName] = &localExecutor{nodeName: nodeName}
+		} else {
+			executors[nodeName] = &sshExecutor{host: host, pool: pool}
+		}
+	}
 
 	client := SmartOSClient{
-		hosts:           d.Get("hosts").(map[string]interface{}),
-		user:            d.Get("user").(string),
+		hosts:           hosts,
+		executors:       executors,
+		pool:            pool,
+		retryPolicy:     &retryPolicy,
 		agentConnection: agentConnection,
-		authMethods:     authMethods,
-		clients:         make(map[string]*ssh.Client),
 	}
 
+	configuredClients.Lock()
+	configuredClients.clients = append(configuredClients.clients, &client)
+	configuredClients.Unlock()
+
 	return &client, nil
 }
+
+// configuredClients tracks the clients created by providerConfigure so that their connections
+// can be closed when the provider shuts down.
+var configuredClients struct {
+	sync.Mutex
+	clients []*SmartOSClient
+}
+
+// CloseClients closes the connections of every client configured by this provider process.
+func CloseClients() {
+	configuredClients.Lock()
+	defer configuredClients.Unlock()
+
+	for _, client := range configuredClients.clients {
+		client.Close()
+	}
+	configuredClients.clients = nil
+}
@@ -0,0 +1,194 @@
+package smartos
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/terraform"
+)
+
+// testProviderFactories serves the provider in-process so that acceptance tests can reach the
+// fake SmartOS server started by the test.
+var testProviderFactories = map[string]func() (*schema.Provider, error){
+	"smartos": func() (*schema.Provider, error) {
+		return Provider(), nil
+	},
+}
+
+func TestProvider(t *testing.T) {
+	if err := Provider().InternalValidate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testClient configures the provider against the fake server and returns its client.
+func testClient(t *testing.T, f *fakeSmartOS, overrides map[string]interface{}) *SmartOSClient {
+	raw := f.ProviderRawConfig()
+	for k, v := range overrides {
+		raw[k] = v
+	}
+
+	provider := Provider()
+	diags := provider.Configure(context.Background(), terraform.NewResourceConfigRaw(raw))
+	if diags.HasError() {
+		t.Fatalf("failed to configure provider: %+v", diags)
+	}
+
+	return provider.Meta().(*SmartOSClient)
+}
+
+func TestProviderConfigure_hostsMap(t *testing.T) {
+	raw := map[string]interface{}{
+		"hosts": map[string]interface{}{
+			"node1": "10.0.0.1",
+			"node2": "10.0.0.2:2222",
+		},
+		"password": "secret",
+	}
+
+	provider := Provider()
+	diags := provider.Configure(context.Background(), terraform.NewResourceConfigRaw(raw))
+	if diags.HasError() {
+		t.Fatalf("failed to configure provider: %+v", diags)
+	}
+
+	client := provider.Meta().(*SmartOSClient)
+	defer client.Close()
+
+	if endpoint := client.hosts["node1"].Endpoint(); endpoint != "10.0.0.1:22" {
+		t.Errorf("node1 endpoint = %s, want 10.0.0.1:22", endpoint)
+	}
+
+	if endpoint := client.hosts["node2"].Endpoint(); endpoint != "10.0.0.2:2222" {
+		t.Errorf("node2 endpoint = %s, want 10.0.0.2:2222", endpoint)
+	}
+}
+
+func TestProviderConfigure_unknownFingerprintHost(t *testing.T) {
+	raw := map[string]interface{}{
+		"hosts": map[string]interface{}{
+			"node1": "10.0.0.1",
+		},
+		"host_key_fingerprints": map[string]interface{}{
+			"node2": "SHA256:AAAA",
+		},
+		"password": "secret",
+	}
+
+	diags := Provider().Configure(context.Background(), terraform.NewResourceConfigRaw(raw))
+	if !diags.HasError() {
+		t.Fatal("expected an error for a fingerprint of an unknown host")
+	}
+}
+
+func TestProviderConfigure_hostBlocks(t *testing.T) {
+	defaultKey, defaultPublicKey := testPrivateKey(t, "hunter2")
+	hostKey, _ := testPrivateKey(t, "")
+
+	raw := map[string]interface{}{
+		"port":                   2222,
+		"user":                   "admin",
+		"private_key":            defaultKey,
+		"private_key_passphrase": "hunter2",
+		"certificate":            testCertificate(t, defaultPublicKey),
+		"password":               "secret",
+		"max_sessions":           4,
+		"host": []interface{}{
+			map[string]interface{}{
+				"name":    "node1",
+				"address": "10.0.0.1",
+			},
+			map[string]interface{}{
+				"name":         "node2",
+				"address":      "10.0.0.2",
+				"port":         22,
+				"user":         "root",
+				"private_key":  hostKey,
+				"max_sessions": 0,
+			},
+			map[string]interface{}{
+				"name":         "node3",
+				"address":      "10.0.0.3",
+				"password":     "other",
+				"max_sessions": 1,
+			},
+		},
+	}
+
+	provider := Provider()
+	diags := provider.Configure(context.Background(), terraform.NewResourceConfigRaw(raw))
+	if diags.HasError() {
+		t.Fatalf("failed to configure provider: %+v", diags)
+	}
+
+	client := provider.Meta().(*SmartOSClient)
+	defer client.Close()
+
+	// node1 only has an address and takes everything else from the provider.
+	node1 := client.hosts["node1"]
+	if node1.Endpoint() != "10.0.0.1:2222" || node1.User != "admin" || node1.MaxSessions != 4 {
+		t.Errorf("node1 = %s as %s with %d sessions, want 10.0.0.1:2222 as admin with 4", node1.Endpoint(), node1.User, node1.MaxSessions)
+	}
+
+	if node1.Credentials.PrivateKey != defaultKey || node1.Credentials.PrivateKeyPassphrase != "hunter2" || node1.Credentials.Certificate == "" {
+		t.Errorf("node1 does not use the provider's key, passphrase and certificate")
+	}
+
+	// node2's own key replaces the provider's passphrase and certificate, which belong to the
+	// provider's key, and a limit of 0 falls back to the provider's.
+	node2 := client.hosts["node2"]
+	if node2.Endpoint() != "10.0.0.2:22" || node2.User != "root" || node2.MaxSessions != 4 {
+		t.Errorf("node2 = %s as %s with %d sessions, want 10.0.0.2:22 as root with 4", node2.Endpoint(), node2.User, node2.MaxSessions)
+	}
+
+	want := Credentials{PrivateKey: hostKey, Password: "secret"}
+	if node2.Credentials != want {
+		t.Errorf("node2 credentials = %+v, want only its own key and the provider's password", node2.Credentials)
+	}
+
+	// node3 only replaces the password.
+	node3 := client.hosts["node3"]
+	if node3.Credentials.Password != "other" || node3.Credentials.PrivateKey != defaultKey || node3.MaxSessions != 1 {
+		t.Errorf("node3 = %+v with %d sessions, want the provider's key, its own password and 1 session", node3.Credentials, node3.MaxSessions)
+	}
+}
+
+func TestProviderConfigure_duplicateHosts(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		raw  map[string]interface{}
+		err  string
+	}{
+		{
+			name: "hosts map and host block",
+			raw: map[string]interface{}{
+				"hosts": map[string]interface{}{"node1": "10.0.0.1"},
+				"host": []interface{}{
+					map[string]interface{}{"name": "node1", "address": "10.0.0.2"},
+				},
+			},
+			err: "host node1 is defined in both hosts and a host block",
+		},
+		{
+			name: "host blocks",
+			raw: map[string]interface{}{
+				"host": []interface{}{
+					map[string]interface{}{"name": "node1", "address": "10.0.0.1"},
+					map[string]interface{}{"name": "node1", "address": "10.0.0.2"},
+				},
+			},
+			err: "more than one host block is named node1",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.raw["password"] = "secret"
+
+			diags := Provider().Configure(context.Background(), terraform.NewResourceConfigRaw(tc.raw))
+			if !diags.HasError() || !strings.Contains(diags[0].Summary, tc.err) {
+				t.Fatalf("diagnostics = %+v, want %q", diags, tc.err)
+			}
+		})
+	}
+}
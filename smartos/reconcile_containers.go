@@ -11,6 +11,7 @@ type ItemEqualFunc func(interface{}, interface{}) bool
 type RemoveItemFunc func(string)
 
 // ReconcileMaps compares two maps; one with old data and one with new data and calls the various argument functions reflecting what operations are necessary to transform the old map into the new.
+// Only the keys are logged, as the values can be sensitive.
 func ReconcileMaps(oldMap map[string]interface{}, newMap map[string]interface{}, addItem AddItemFunc, updateItem UpdateItemFunc, removeItem RemoveItemFunc, itemsAreEqual ItemEqualFunc) bool {
 	changesMade := false
 
@@ -54,18 +55,17 @@ func ReconcileMaps(oldMap map[string]interface{}, newMap map[string]interface{},
 			if !itemsAreEqual(oldValue, newValue) {
 				// Value changed
 				updateItem(oldKey, newValue)
-				log.Printf("COMPARE: Updating [%s] = %s", oldKey, newValue.(string))
+				log.Printf("COMPARE: Updating [%s]", oldKey)
 				changesMade = true
 			} else {
-				log.Printf("COMPARE: No change to [%s] = %s", oldKey, newValue.(string))
+				log.Printf("COMPARE: No change to [%s]", oldKey)
 			}
 			newKeyIndex++
 			oldKeyIndex++
 		} else if oldKey < newKey {
 			// 'oldKey' was removed
-			oldValue := oldMap[oldKey].(string)
 			removeItem(oldKey)
-			log.Printf("COMPARE: Removing [%s] = %s", oldKey, oldValue)
+			log.Printf("COMPARE: Removing [%s]", oldKey)
 			changesMade = true
 
 			oldKeyIndex++
@@ -74,7 +74,7 @@ func ReconcileMaps(oldMap map[string]interface{}, newMap map[string]interface{},
 			newValue := newMap[newKey]
 
 			addItem(newKey, newValue)
-			log.Printf("COMPARE: Adding [%s] = %s", newKey, newValue.(string))
+			log.Printf("COMPARE: Adding [%s]", newKey)
 
 			newKeyIndex++
 			changesMade = true
@@ -84,9 +84,8 @@ func ReconcileMaps(oldMap map[string]interface{}, newMap map[string]interface{},
 	// Remove any remaining old keys
 	for ; oldKeyIndex < len(oldKeys); oldKeyIndex++ {
 		oldKey := oldKeys[oldKeyIndex]
-		oldValue := oldMap[oldKey].(string)
 		removeItem(oldKey)
-		log.Printf("COMPARE: Removing at end [%s] = %s", oldKey, oldValue)
+		log.Printf("COMPARE: Removing at end [%s]", oldKey)
 		changesMade = true
 	}
 
@@ -96,7 +95,7 @@ func ReconcileMaps(oldMap map[string]interface{}, newMap map[string]interface{},
 		newValue := newMap[newKey]
 
 		addItem(newKey, newValue)
-		log.Printf("COMPARE: Adding at end [%s] = %s", newKey, newValue.(string))
+		log.Printf("COMPARE: Adding at end [%s]", newKey)
 		changesMade = true
 	}
 
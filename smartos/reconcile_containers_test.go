@@ -0,0 +1,44 @@
+package smartos
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReconcileMaps(t *testing.T) {
+	var output bytes.Buffer
+	log.SetOutput(&output)
+	defer log.SetOutput(os.Stderr)
+
+	oldMap := map[string]interface{}{"kept": "k3pt", "changed": "0ld", "removed": "g0ne"}
+	newMap := map[string]interface{}{"kept": "k3pt", "changed": "n3w", "added": "addd"}
+
+	set := map[string]interface{}{}
+	var removed []string
+
+	setItem := func(key string, value interface{}) { set[key] = value }
+	removeItem := func(key string) { removed = append(removed, key) }
+
+	if !ReconcileMaps(oldMap, newMap, setItem, setItem, removeItem, stringsAreEqual) {
+		t.Fatal("no changes reported")
+	}
+
+	if want := map[string]interface{}{"changed": "n3w", "added": "addd"}; !reflect.DeepEqual(set, want) {
+		t.Errorf("set %v, want %v", set, want)
+	}
+
+	if want := []string{"removed"}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("removed %v, want %v", removed, want)
+	}
+
+	// Values such as internal_metadata are sensitive and stay out of the logs.
+	for _, value := range []string{"k3pt", "0ld", "n3w", "g0ne", "addd"} {
+		if strings.Contains(output.String(), value) {
+			t.Errorf("log contains the value %q:\n%s", value, output.String())
+		}
+	}
+}
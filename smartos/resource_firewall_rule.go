@@ -0,0 +1,161 @@
+package smartos
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+)
+
+func resourceFirewallRule() *schema.Resource {
+	return &schema.Resource{
+		CreateContext: resourceFirewallRuleCreate,
+		ReadContext:   resourceFirewallRuleRead,
+		UpdateContext: resourceFirewallRuleUpdate,
+		DeleteContext: resourceFirewallRuleDelete,
+
+		Importer: &schema.ResourceImporter{
+			StateContext: resourceFirewallRuleImport,
+		},
+
+		Timeouts: &schema.ResourceTimeout{
+			Create: schema.DefaultTimeout(5 * time.Minute),
+			Read:   schema.DefaultTimeout(5 * time.Minute),
+			Update: schema.DefaultTimeout(5 * time.Minute),
+			Delete: schema.DefaultTimeout(5 * time.Minute),
+		},
+
+		Schema: map[string]*schema.Schema{
+			"node_name": {
+				Type:     schema.TypeString,
+				Required: true,
+				ForceNew: true,
+			},
+			"rule": {
+				Type:         schema.TypeString,
+				Required:     true,
+				ValidateFunc: validateFirewallRule,
+				DiffSuppressFunc: func(k, old, new string, d *schema.ResourceData) bool {
+					return firewallRulesEqual(old, new)
+				},
+			},
+			"enabled": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  true,
+			},
+			"description": {
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+		},
+	}
+}
+
+func (r *FirewallRule) LoadFromSchema(d *schema.ResourceData) {
+	r.NodeName = d.Get("node_name").(string)
+	r.Rule = normalizeFirewallRule(d.Get("rule").(string))
+	r.Enabled = d.Get("enabled").(bool)
+	r.Description = d.Get("description").(string)
+}
+
+func (r *FirewallRule) SaveToSchema(d *schema.ResourceData) error {
+	values := map[string]interface{}{
+		"node_name":   r.NodeName,
+		"rule":        r.Rule,
+		"enabled":     r.Enabled,
+		"description": r.Description,
+	}
+
+	for key, value := range values {
+		if err := d.Set(key, value); err != nil {
+			return fmt.Errorf("failed to set %s: %s", key, err)
+		}
+	}
+
+	return nil
+}
+
+// resourceFirewallRuleImport accepts node_name/uuid.
+func resourceFirewallRuleImport(ctx context.Context, d *schema.ResourceData, m interface{}) ([]*schema.ResourceData, error) {
+	if _, _, err := parseId(d.Id()); err != nil {
+		return nil, fmt.Errorf("unexpected import ID %q, expected node_name/uuid", d.Id())
+	}
+
+	return []*schema.ResourceData{d}, nil
+}
+
+func resourceFirewallRuleCreate(ctx context.Context, d *schema.ResourceData, m interface{}) diag.Diagnostics {
+	client := m.(*SmartOSClient)
+
+	rule := FirewallRule{}
+	rule.LoadFromSchema(d)
+
+	id, err := client.CreateFirewallRule(ctx, rule.NodeName, &rule)
+	if err != nil {
+		return diag.FromErr(err)
+	}
+
+	d.SetId(createId(rule.NodeName, *id))
+
+	return resourceFirewallRuleRead(ctx, d, m)
+}
+
+func resourceFirewallRuleRead(ctx context.Context, d *schema.ResourceData, m interface{}) diag.Diagnostics {
+	client := m.(*SmartOSClient)
+	nodeName, id, err := parseId(d.Id())
+	if err != nil {
+		return diag.FromErr(err)
+	}
+
+	rule, err := client.GetFirewallRule(ctx, nodeName, id)
+	if errors.Is(err, ErrNotFound) && !d.IsNewResource() {
+		log.Printf("Firewall rule with ID %s no longer exists, removing it from state", d.Id())
+		d.SetId("")
+		return nil
+	}
+
+	if err != nil {
+		return diag.FromErr(err)
+	}
+
+	return diag.FromErr(rule.SaveToSchema(d))
+}
+
+func resourceFirewallRuleUpdate(ctx context.Context, d *schema.ResourceData, m interface{}) diag.Diagnostics {
+	client := m.(*SmartOSClient)
+	nodeName, id, err := parseId(d.Id())
+	if err != nil {
+		return diag.FromErr(err)
+	}
+
+	rule := FirewallRule{ID: &id}
+	rule.LoadFromSchema(d)
+
+	err = client.UpdateFirewallRule(ctx, nodeName, &rule)
+	if err != nil {
+		return diag.FromErr(err)
+	}
+
+	return resourceFirewallRuleRead(ctx, d, m)
+}
+
+func resourceFirewallRuleDelete(ctx context.Context, d *schema.ResourceData, m interface{}) diag.Diagnostics {
+	client := m.(*SmartOSClient)
+	nodeName, id, err := parseId(d.Id())
+	if err != nil {
+		return diag.FromErr(err)
+	}
+
+	err = client.DeleteFirewallRule(ctx, nodeName, id)
+	if errors.Is(err, ErrNotFound) {
+		log.Printf("Firewall rule with ID %s was already deleted", d.Id())
+		return nil
+	}
+
+	return diag.FromErr(err)
+}
@@ -0,0 +1,208 @@
+package smartos
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/resource"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/terraform"
+)
+
+func testAccFirewallRuleConfig(f *fakeSmartOS, rule string, enabled bool, firewallEnabled bool) string {
+	return f.ProviderConfig() + fmt.Sprintf(`
+resource "smartos_machine" "test" {
+  node_name        = "node1"
+  alias            = "web"
+  brand            = "joyent"
+  image_uuid       = %q
+  firewall_enabled = %t
+}
+
+resource "smartos_firewall_rule" "ssh" {
+  node_name   = "node1"
+  rule        = %q
+  enabled     = %t
+  description = "SSH from anywhere"
+}
+`, testImage.UUID, firewallEnabled, rule, enabled)
+}
+
+func testAccCheckFirewallRuleDestroy(f *fakeSmartOS) resource.TestCheckFunc {
+	return func(s *terraform.State) error {
+		for _, rs := range s.RootModule().Resources {
+			if rs.Type != "smartos_firewall_rule" {
+				continue
+			}
+
+			_, id, err := parseId(rs.Primary.ID)
+			if err != nil {
+				return err
+			}
+
+			if f.FirewallRule(id.String()) != nil {
+				return fmt.Errorf("firewall rule %s still exists", rs.Primary.ID)
+			}
+		}
+
+		return nil
+	}
+}
+
+func testAccCheckFirewallRule(f *fakeSmartOS, name string, key string, value interface{}) resource.TestCheckFunc {
+	return func(s *terraform.State) error {
+		rs, ok := s.RootModule().Resources[name]
+		if !ok {
+			return fmt.Errorf("%s not found in state", name)
+		}
+
+		_, id, err := parseId(rs.Primary.ID)
+		if err != nil {
+			return err
+		}
+
+		rule := f.FirewallRule(id.String())
+		if rule == nil {
+			return fmt.Errorf("firewall rule %s does not exist", id)
+		}
+
+		if rule[key] != value {
+			return fmt.Errorf("firewall rule %s = %v, want %v", key, rule[key], value)
+		}
+
+		return nil
+	}
+}
+
+func TestAccFirewallRule_basic(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+	f.AddAvailableImage(testImage)
+
+	var id string
+
+	resource.Test(t, resource.TestCase{
+		ProviderFactories: testProviderFactories,
+		CheckDestroy: resource.ComposeTestCheckFunc(
+			testAccCheckFirewallRuleDestroy(f),
+			testAccCheckMachineDestroy(f),
+		),
+		Steps: []resource.TestStep{
+			{
+				// fwadm reports keywords in upper case, which is not a change.
+				Config: testAccFirewallRuleConfig(f, "from any to all vms allow tcp port 22", true, true),
+				Check: resource.ComposeTestCheckFunc(
+					testAccCheckMachineID("smartos_firewall_rule.ssh", &id),
+					resource.TestCheckResourceAttr("smartos_firewall_rule.ssh", "rule", "FROM any TO all vms ALLOW tcp PORT 22"),
+					testAccCheckFirewallRule(f, "smartos_firewall_rule.ssh", "enabled", true),
+					testAccCheckFirewallRule(f, "smartos_firewall_rule.ssh", "description", "SSH from anywhere"),
+					resource.TestCheckResourceAttr("smartos_machine.test", "firewall_enabled", "true"),
+				),
+			},
+			{
+				Config: testAccFirewallRuleConfig(f, "FROM any TO all vms ALLOW tcp (PORT 22 OR PORT 2222)", false, false),
+				Check: resource.ComposeTestCheckFunc(
+					testAccCheckMachineID("smartos_firewall_rule.ssh", &id),
+					testAccCheckFirewallRule(f, "smartos_firewall_rule.ssh", "rule", "FROM any TO all vms ALLOW tcp (PORT 22 OR PORT 2222)"),
+					testAccCheckFirewallRule(f, "smartos_firewall_rule.ssh", "enabled", false),
+					testAccCheckMachineProperty(f, "web", "firewall_enabled", false),
+				),
+			},
+			{
+				ResourceName:      "smartos_firewall_rule.ssh",
+				ImportState:       true,
+				ImportStateVerify: true,
+			},
+		},
+	})
+}
+
+func TestAccFirewallRule_disappears(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+	f.AddAvailableImage(testImage)
+
+	var id string
+
+	resource.Test(t, resource.TestCase{
+		ProviderFactories: testProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				Config: testAccFirewallRuleConfig(f, "FROM any TO all vms ALLOW tcp PORT 22", true, false),
+				Check: resource.ComposeTestCheckFunc(
+					testAccCheckMachineID("smartos_firewall_rule.ssh", &id),
+					func(*terraform.State) error {
+						_, ruleID, err := parseId(id)
+						if err != nil {
+							return err
+						}
+
+						f.lock.Lock()
+						delete(f.firewallRules, ruleID.String())
+						f.lock.Unlock()
+						return nil
+					},
+				),
+				ExpectNonEmptyPlan: true,
+			},
+		},
+	})
+}
+
+func TestValidateFirewallRule(t *testing.T) {
+	valid := []string{
+		"FROM any TO all vms ALLOW tcp PORT 22",
+		"from any to all vms allow tcp port 22",
+		"FROM (subnet 10.0.0.0/8 OR ip 192.168.1.1) TO tag role = web ALLOW tcp (PORT 80 AND PORT 443)",
+		"FROM all vms TO any BLOCK udp PORTS 1000-2000",
+		"FROM any TO vm 1a2b3c4d-0000-0000-0000-000000000000 ALLOW icmp TYPE 8 CODE 0",
+		"FROM any TO all vms ALLOW ah",
+		"FROM  any\n TO all vms ALLOW tcp PORT all",
+	}
+
+	for _, rule := range valid {
+		if _, errs := validateFirewallRule(rule, "rule"); len(errs) != 0 {
+			t.Errorf("%q: unexpected errors %v", rule, errs)
+		}
+	}
+
+	invalid := map[string]string{
+		"ALLOW tcp PORT 22":                      "is not a fwadm rule",
+		"FROM any TO all vms PERMIT tcp PORT 22": "is not a fwadm rule",
+		"FROM any TO all vms ALLOW sctp PORT 22": "is not a fwadm rule",
+		"FROM any TO all vms ALLOW tcp":          "need PORT",
+		"FROM any TO all vms ALLOW icmp PORT 8":  "need TYPE",
+		"FROM any TO all vms ALLOW udp (TYPE 8)": "need PORT",
+		"FROM any ALLOW tcp PORT 22":             "is not a fwadm rule",
+		"":                                       "is not a fwadm rule",
+	}
+
+	for rule, want := range invalid {
+		_, errs := validateFirewallRule(rule, "rule")
+		if len(errs) != 1 || !strings.Contains(errs[0].Error(), want) {
+			t.Errorf("%q: errors = %v, want one containing %q", rule, errs, want)
+		}
+	}
+}
+
+func TestFirewallRulesEqual(t *testing.T) {
+	for _, tc := range []struct {
+		a     string
+		b     string
+		equal bool
+	}{
+		{"from any to all vms allow tcp port 22", "FROM any TO all vms ALLOW tcp PORT 22", true},
+		{"FROM ANY TO ALL VMS ALLOW TCP (port 22 or PORT 2222)", "FROM any TO all vms ALLOW tcp (PORT 22 OR PORT 2222)", true},
+		{"FROM  any\n TO tag role = web ALLOW tcp PORT 80", "FROM any TO tag role = web ALLOW tcp PORT 80", true},
+
+		// fwadm matches tag names and values by case.
+		{"FROM any TO tag role = Web ALLOW tcp PORT 80", "FROM any TO tag role = web ALLOW tcp PORT 80", false},
+		{"FROM any TO tag Role = web ALLOW tcp PORT 80", "FROM any TO tag role = web ALLOW tcp PORT 80", false},
+		{`FROM any TO tag "role" = "All" ALLOW tcp PORT 80`, `FROM any TO tag "role" = "all" ALLOW tcp PORT 80`, false},
+		{"FROM any TO all vms ALLOW tcp PORT 22", "FROM any TO all vms ALLOW tcp PORT 2222", false},
+	} {
+		if equal := firewallRulesEqual(tc.a, tc.b); equal != tc.equal {
+			t.Errorf("firewallRulesEqual(%q, %q) = %t, want %t", tc.a, tc.b, equal, tc.equal)
+		}
+	}
+}
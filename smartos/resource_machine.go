@@ -1,22 +1,98 @@
 package smartos
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/diag"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/validation"
+)
+
+var macAddressPattern = regexp.MustCompile(`^([0-9a-fA-F]{2}:){5}[0-9a-fA-F]{2}$`)
+
+var bootromPattern = regexp.MustCompile(`^(bios|uefi|/.+)$`)
+
+var absolutePathPattern = regexp.MustCompile(`^/`)
+
+var routeNICPattern = regexp.MustCompile(`^nics\[[0-9]+\]$`)
+
+var internalMetadataNamespacePattern = regexp.MustCompile(`^[^:\s]+$`)
+
+var hostnamePattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+var dnsDomainPattern = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)*[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+var indestructiblePattern = regexp.MustCompile(`indestructible_(delegated|zoneroot)`)
+
+// brandArguments lists the brands that support arguments specific to hardware virtualized
+// machines.
+var brandArguments = map[string][]string{
+	"bhyve_extra_opts":   {"bhyve"},
+	"bootrom":            {"bhyve"},
+	"cpu_type":           {"kvm"},
+	"disk_driver":        {"bhyve", "kvm"},
+	"flexible_disk_size": {"bhyve"},
+	"nic_driver":         {"bhyve", "kvm"},
+	"vga":                {"kvm"},
+	"vnc_password":       {"bhyve", "kvm"},
+	"vnc_port":           {"bhyve", "kvm"},
+}
+
+// brandDiskArguments lists the brands that support disks arguments.
+var brandDiskArguments = map[string][]string{
+	"pci_slot":       {"bhyve"},
+	"refreservation": {"bhyve"},
+}
+
+// Disk and NIC models each brand emulates.
+var (
+	brandDiskModels = map[string][]string{
+		"bhyve": {"ahci", "nvme", "virtio"},
+		"kvm":   {"ide", "scsi", "virtio"},
+	}
+	brandNICModels = map[string][]string{
+		"bhyve": {"e1000", "virtio"},
+		"kvm":   {"e1000", "rtl8139", "virtio"},
+	}
+
+	diskModels = []string{"ahci", "ide", "nvme", "scsi", "virtio"}
+	nicModels  = []string{"e1000", "rtl8139", "virtio"}
 )
 
 func resourceMachine() *schema.Resource {
 	return &schema.Resource{
-		Create: resourceMachineCreate,
-		Read:   resourceMachineRead,
-		Update: resourceMachineUpdate,
-		Delete: resourceMachineDelete,
+		CreateContext: resourceMachineCreate,
+		ReadContext:   resourceMachineRead,
+		UpdateContext: resourceMachineUpdate,
+		DeleteContext: resourceMachineDelete,
+
+		Importer: &schema.ResourceImporter{
+			StateContext: resourceMachineImport,
+		},
+
+		CustomizeDiff: resourceMachineCustomizeDiff,
+
+		Timeouts: &schema.ResourceTimeout{
+			Create: schema.DefaultTimeout(10 * time.Minute),
+			Read:   schema.DefaultTimeout(5 * time.Minute),
+			Update: schema.DefaultTimeout(10 * time.Minute),
+			Delete: schema.DefaultTimeout(10 * time.Minute),
+		},
 
 		Schema: map[string]*schema.Schema{
+			"stop_for_disk_changes": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
 			"serial_code": {
 				Type:     schema.TypeString,
 				Optional: true,
@@ -40,27 +116,31 @@ func resourceMachine() *schema.Resource {
 			"autoboot": {
 				Type:     schema.TypeBool,
 				Optional: true,
+				Computed: true,
 			},
 			/*
 				"billing_id": {
 					Type:     schema.TypeString,
 					Optional: true,
 				},
-				"bhyve_extra_opts": {
-					Type:     schema.TypeString,
-					Optional: true,
-					ForceNew: true,
-				},
+			*/
+			"bhyve_extra_opts": {
+				Type:     schema.TypeString,
+				Optional: true,
+				Computed: true,
+			},
+			/*
 				"boot": {
 					Type:     schema.TypeString,
 					Optional: true,
 				},
-				"bootrom": {
-					Type:     schema.TypeString,
-					Optional: true,
-					ForceNew: true,
-				},
 			*/
+			"bootrom": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Computed:     true,
+				ValidateFunc: validation.StringMatch(bootromPattern, "must be bios, uefi or the absolute path of a bootrom"),
+			},
 			"brand": {
 				Type:     schema.TypeString,
 				Required: true,
@@ -75,12 +155,13 @@ func resourceMachine() *schema.Resource {
 					Type:     schema.TypeInt,
 					Optional: true,
 				},
-					"cpu_type": {
-						Type:     schema.TypeString,
-						Optional: true,
-						ForceNew: true,
-					},
 			*/
+			"cpu_type": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Computed:     true,
+				ValidateFunc: validation.StringInSlice([]string{"host", "qemu64"}, false),
+			},
 			"customer_metadata": {
 				Type:     schema.TypeMap,
 				Optional: true,
@@ -89,115 +170,169 @@ func resourceMachine() *schema.Resource {
 				Type:     schema.TypeMap,
 				Computed: true,
 			},
-			/*
-				"delegate_dataset": {
-					Type:     schema.TypeBool,
-					Optional: true,
-				},
-			*/
+			"delegate_dataset": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Computed: true,
+				ForceNew: true,
+			},
 			"disks": {
 				Type:     schema.TypeList,
 				Optional: true,
-				ForceNew: true,
 				Elem: &schema.Resource{
 					Schema: map[string]*schema.Schema{
 						"boot": {
 							Type:     schema.TypeBool,
 							Optional: true,
-							ForceNew: true,
 						},
 						"compression": {
 							Type:     schema.TypeString,
 							Optional: true,
-							ForceNew: true,
+							Computed: true,
 						},
 						"image_uuid": {
 							Type:     schema.TypeString,
 							Optional: true,
-							ForceNew: true,
 						},
 						"image_size": { // in MiB
 							Type:     schema.TypeInt,
 							Optional: true,
-							ForceNew: true,
+							Computed: true,
 						},
 						"model": {
+							Type:         schema.TypeString,
+							Optional:     true,
+							Computed:     true,
+							ValidateFunc: validation.StringInSlice(diskModels, false),
+						},
+						"path": {
 							Type:     schema.TypeString,
 							Optional: true,
-							ForceNew: true,
+							Computed: true,
+						},
+						"pci_slot": {
+							Type:     schema.TypeString,
+							Optional: true,
+							Computed: true,
+						},
+						"refreservation": { // in MiB
+							Type:     schema.TypeInt,
+							Optional: true,
+							Computed: true,
 						},
 						"size": { // in MiB
 							Type:     schema.TypeInt,
 							Optional: true,
-							ForceNew: true,
+							Computed: true,
 						},
 					},
 				},
 			},
+			"disk_driver": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Computed:     true,
+				ValidateFunc: validation.StringInSlice(diskModels, false),
+			},
 			/*
-				"disk_driver": {
-					Type:     schema.TypeString,
-					Optional: true,
-					ForceNew: true,
-				},
 				"do_not_inventory": {
 					Type:     schema.TypeBool,
 					Optional: true,
 				},
-				"dns_domain": {
-					Type:     schema.TypeString,
-					Optional: true,
-				},
-				// "filesystems.*"
-				"firewall_enabled": {
-					Type:     schema.TypeBool,
-					Optional: true,
-				},
-				"flexible_disk_size": {
-					Type:     schema.TypeInt,
-					Optional: true,
+			*/
+			"dns_domain": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Computed:     true,
+				ForceNew:     true,
+				ValidateFunc: validation.StringMatch(dnsDomainPattern, "must be a DNS domain such as example.com"),
+			},
+			"filesystems": {
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"source": {
+							Type:     schema.TypeString,
+							Required: true,
+						},
+						"target": {
+							Type:         schema.TypeString,
+							Required:     true,
+							ValidateFunc: validation.StringMatch(absolutePathPattern, "must be an absolute path"),
+						},
+						"type": {
+							Type:     schema.TypeString,
+							Optional: true,
+							Default:  "lofs",
+						},
+						"options": {
+							Type:     schema.TypeList,
+							Optional: true,
+							Elem: &schema.Schema{
+								Type: schema.TypeString,
+							},
+						},
+					},
 				},
+			},
+			"firewall_enabled": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Computed: true,
+			},
+			"flexible_disk_size": { // in MiB
+				Type:     schema.TypeInt,
+				Optional: true,
+				Computed: true,
+			},
+			/*
 				"fs_allowed": {
 					Type:     schema.TypeString,
 					Optional: true,
 				},
-				"hostname": {
-					Type:     schema.TypeString,
-					Optional: true,
-				},
 			*/
+			"hostname": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Computed:     true,
+				ValidateFunc: validation.StringMatch(hostnamePattern, "must be a host name of letters, digits and hyphens"),
+			},
 			"image_uuid": {
 				Type:     schema.TypeString,
 				Optional: true,
 				ForceNew: true,
 			},
-			/*
-				"internal_metadata": {
-					Type:     schema.TypeList,
-					Optional: true,
-					Elem: {
-						Type: schema.TypeString,
-					},
-				},
-				"internal_metadata_namespaces": {
-					Type:     schema.TypeList,
-					Optional: true,
-					Elem: {
-						Type: schema.TypeString,
-					},
-				},
-				"indestructible_delegated": {
-					Type:     schema.TypeBool,
-					Optional: true,
+			"internal_metadata": {
+				Type:      schema.TypeMap,
+				Optional:  true,
+				Sensitive: true,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
 				},
-				"indestructible_zoneroot": {
-					Type:     schema.TypeBool,
-					Optional: true,
+			},
+			"internal_metadata_namespaces": {
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem: &schema.Schema{
+					Type:         schema.TypeString,
+					ValidateFunc: validation.StringMatch(internalMetadataNamespacePattern, "must be a namespace name without the trailing colon"),
 				},
-			*/
+			},
+			"indestructible_delegated": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
+			"indestructible_zoneroot": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
 			"kernel_version": {
 				Type:     schema.TypeString,
 				Optional: true,
+				Computed: true,
 				ForceNew: true,
 			},
 			/*
@@ -209,6 +344,7 @@ func resourceMachine() *schema.Resource {
 			"maintain_resolvers": {
 				Type:     schema.TypeBool,
 				Optional: true,
+				Computed: true,
 			},
 			/*
 				"max_locked_memory": {
@@ -223,6 +359,7 @@ func resourceMachine() *schema.Resource {
 			"max_physical_memory": {
 				Type:     schema.TypeInt,
 				Optional: true,
+				Computed: true,
 			},
 			/*
 				"max_swap": {
@@ -237,78 +374,82 @@ func resourceMachine() *schema.Resource {
 			"nics": {
 				Type:     schema.TypeList,
 				Optional: true,
-				ForceNew: true,
 				Elem: &schema.Resource{
 					Schema: map[string]*schema.Schema{
 						"allow_restricted_traffic": {
 							Type:     schema.TypeBool,
 							Optional: true,
-							ForceNew: true,
 						},
 						"allow_ip_spoofing": {
 							Type:     schema.TypeBool,
 							Optional: true,
-							ForceNew: true,
 						},
 						"allow_mac_spoofing": {
 							Type:     schema.TypeBool,
 							Optional: true,
-							ForceNew: true,
 						},
 						"gateways": {
 							Type:     schema.TypeList,
 							Optional: true,
-							ForceNew: true,
 							Elem: &schema.Schema{
-								Type: schema.TypeString,
+								Type:         schema.TypeString,
+								ValidateFunc: validation.IsIPAddress,
 							},
 						},
 						"interface": {
 							Type:     schema.TypeString,
 							Required: true,
-							ForceNew: true,
 						},
 						"ips": {
 							Type:     schema.TypeList,
 							Required: true,
-							ForceNew: true,
 							Elem: &schema.Schema{
 								Type: schema.TypeString,
 							},
 						},
+						"mac": {
+							Type:         schema.TypeString,
+							Optional:     true,
+							Computed:     true,
+							ValidateFunc: validation.StringMatch(macAddressPattern, "must be a MAC address such as 90:b8:d0:12:34:56"),
+						},
 						"nic_tag": {
 							Type:     schema.TypeString,
 							Required: true,
-							ForceNew: true,
 						},
 						"model": {
-							Type:     schema.TypeString,
+							Type:         schema.TypeString,
+							Optional:     true,
+							Computed:     true,
+							ValidateFunc: validation.StringInSlice(nicModels, false),
+						},
+						"primary": {
+							Type:     schema.TypeBool,
 							Optional: true,
-							ForceNew: true,
+							Computed: true,
 						},
 						"vlan_id": {
 							Type:     schema.TypeInt,
 							Optional: true,
-							ForceNew: true,
 						},
 						"vrrp_vrid": {
 							Type:     schema.TypeInt,
 							Optional: true,
-							ForceNew: true,
 						},
 						"vrrp_primary_ip": {
 							Type:     schema.TypeString,
 							Optional: true,
-							ForceNew: true,
 						},
 					},
 				},
 			},
+			"nic_driver": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Computed:     true,
+				ValidateFunc: validation.StringInSlice(nicModels, false),
+			},
 			/*
-				"nic_driver": {
-					Type:     schema.TypeString,
-					Optional: true,
-				},
 				"nowait": {
 					Type:     schema.TypeBool,
 					Optional: true,
@@ -333,20 +474,38 @@ func resourceMachine() *schema.Resource {
 			"quota": {
 				Type:     schema.TypeInt,
 				Optional: true,
+				Computed: true,
 			},
 			"ram": {
 				Type:     schema.TypeInt,
 				Optional: true,
+				Computed: true,
 				ForceNew: true,
 			},
+			"reboot_triggers": {
+				Type:     schema.TypeMap,
+				Optional: true,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+			},
 			"resolvers": {
 				Type:     schema.TypeList,
 				Optional: true,
+				Computed: true,
+				Elem: &schema.Schema{
+					Type:         schema.TypeString,
+					ValidateFunc: validation.IsIPAddress,
+				},
+			},
+			"routes": {
+				Type:         schema.TypeMap,
+				Optional:     true,
+				ValidateFunc: validateRoutes,
 				Elem: &schema.Schema{
 					Type: schema.TypeString,
 				},
 			},
-			// "routes.*" - object
 			/*
 				"spice_opts": {
 					Type:     schema.TypeString,
@@ -369,16 +528,42 @@ func resourceMachine() *schema.Resource {
 					Optional: true,
 				},
 			*/
+			"state": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Computed:     true,
+				ValidateFunc: validation.StringInSlice([]string{"running", "stopped"}, false),
+			},
+			"wait_for_metadata": {
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+			},
+			"wait_for_port": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				ValidateFunc: validation.IntBetween(1, 65535),
+			},
+			"wait_for_running": {
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  false,
+			},
 			"vcpus": {
 				Type:     schema.TypeInt,
 				Optional: true,
+				Computed: true,
 				ForceNew: true,
 			},
+			"vga": {
+				Type:         schema.TypeString,
+				Optional:     true,
+				Computed:     true,
+				ValidateFunc: validation.StringInSlice([]string{"cirrus", "qxl", "std", "vmware", "xenfb"}, false),
+			},
 			/*
-				"vga": {
-					Type:     schema.TypeString,
-					Optional: true,
-				},
 				"virtio_txburst": {
 					Type:     schema.TypeInt,
 					Optional: true,
@@ -387,14 +572,20 @@ func resourceMachine() *schema.Resource {
 					Type:     schema.TypeInt,
 					Optional: true,
 				},
-				"vnc_password": {
-					Type:     schema.TypeString,
-					Optional: true,
-				},
-				"vnc_port": {
-					Type:     schema.TypeInt,
-					Optional: true,
-				},
+			*/
+			"vnc_password": {
+				Type:      schema.TypeString,
+				Optional:  true,
+				Computed:  true,
+				Sensitive: true,
+			},
+			"vnc_port": {
+				Type:         schema.TypeInt,
+				Optional:     true,
+				Computed:     true,
+				ValidateFunc: validation.IntBetween(-1, 65535),
+			},
+			/*
 				"zfs_data_compression": {
 					Type:     schema.TypeString,
 					Optional: true,
@@ -462,7 +653,186 @@ func createId(nodeName string, uuid uuid.UUID) string {
 	return fmt.Sprintf("%s/%s", nodeName, uuid.String())
 }
 
-func resourceMachineCreate(d *schema.ResourceData, m interface{}) error {
+// resourceMachineImport accepts node_name/uuid or node_name/alias.  Aliases are looked up on
+// the node and must be unique there.
+func resourceMachineImport(ctx context.Context, d *schema.ResourceData, m interface{}) ([]*schema.ResourceData, error) {
+	parts := strings.SplitN(d.Id(), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("unexpected import ID %q, expected node_name/uuid or node_name/alias", d.Id())
+	}
+
+	nodeName := parts[0]
+
+	machineId, err := uuid.Parse(parts[1])
+	if err != nil {
+		client := m.(*SmartOSClient)
+
+		id, err := client.FindMachineByAlias(ctx, nodeName, parts[1])
+		if err != nil {
+			return nil, err
+		}
+
+		machineId = *id
+	}
+
+	d.SetId(createId(nodeName, machineId))
+	d.Set("stop_for_disk_changes", false)
+	d.Set("wait_for_running", false)
+
+	return []*schema.ResourceData{d}, nil
+}
+
+// resourceMachineCustomizeDiff rejects arguments the brand does not support and disk changes
+// vmadm cannot make in place: shrinking a disk fails, and a disk created from a different
+// image requires a new machine, as does a new host name for a zone.  Disk removals that cannot
+// be told apart from changes to other disks are rejected as well.
+func resourceMachineCustomizeDiff(ctx context.Context, d *schema.ResourceDiff, m interface{}) error {
+	if err := validateBrandArguments(d); err != nil {
+		return err
+	}
+
+	if d.Get("indestructible_delegated").(bool) && d.NewValueKnown("delegate_dataset") && !d.Get("delegate_dataset").(bool) {
+		return fmt.Errorf("indestructible_delegated requires delegate_dataset")
+	}
+
+	// Zones only pick up their host name when they are created, hardware virtualized machines
+	// get it from DHCP whenever they ask for a lease.
+	if d.Id() != "" && d.HasChange("hostname") && !stringInSlice(d.Get("brand").(string), []string{"bhyve", "kvm"}) {
+		if err := d.ForceNew("hostname"); err != nil {
+			return err
+		}
+	}
+
+	targets := map[string]bool{}
+	for i, fd := range d.Get("filesystems").([]interface{}) {
+		target := fd.(map[string]interface{})["target"].(string)
+		if target == "" {
+			// Not known until apply.
+			continue
+		}
+		if targets[target] {
+			return fmt.Errorf("filesystems.%d: more than one filesystem is mounted on %s", i, target)
+		}
+		targets[target] = true
+	}
+
+	if d.Id() == "" || !d.HasChange("disks") {
+		return nil
+	}
+
+	oldSchemaValue, newSchemaValue := d.GetChange("disks")
+	oldDefinitions := oldSchemaValue.([]interface{})
+	newDefinitions := newSchemaValue.([]interface{})
+
+	if err := checkDiskRemovals(oldDefinitions, newDefinitions); err != nil {
+		return err
+	}
+
+	for i, oldIndex := range matchDisks(oldDefinitions, newDefinitions) {
+		if oldIndex < 0 {
+			continue
+		}
+
+		oldDefinition := oldDefinitions[oldIndex].(map[string]interface{})
+		newDefinition := newDefinitions[i].(map[string]interface{})
+
+		oldSize := oldDefinition["size"].(int)
+		newSize := newDefinition["size"].(int)
+		if newSize > 0 && newSize < oldSize {
+			return fmt.Errorf("disks.%d: cannot shrink disk %s from %d to %d MiB", i, oldDefinition["path"], oldSize, newSize)
+		}
+
+		if oldDefinition["image_uuid"] != newDefinition["image_uuid"] {
+			return d.ForceNew("disks")
+		}
+	}
+
+	return nil
+}
+
+// validateRoutes checks that routes map IP addresses or subnets to a gateway address or to a
+// NIC, given as nics[n].
+func validateRoutes(v interface{}, k string) ([]string, []error) {
+	var errs []error
+
+	for destination, gateway := range v.(map[string]interface{}) {
+		if net.ParseIP(destination) == nil {
+			if _, _, err := net.ParseCIDR(destination); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %q is not an IP address or subnet", k, destination))
+			}
+		}
+
+		if value, _ := gateway.(string); net.ParseIP(value) == nil && !routeNICPattern.MatchString(value) {
+			errs = append(errs, fmt.Errorf("%s.%s: %q is not a gateway address or nics[n]", k, destination, value))
+		}
+	}
+
+	return nil, errs
+}
+
+func validateBrandArguments(d *schema.ResourceDiff) error {
+	if !d.NewValueKnown("brand") {
+		return nil
+	}
+
+	brand := d.Get("brand").(string)
+
+	for key, brands := range brandArguments {
+		if _, ok := d.GetOk(key); ok && !stringInSlice(brand, brands) {
+			return fmt.Errorf("%s is not supported by brand %s, only by %s", key, brand, strings.Join(brands, ", "))
+		}
+	}
+
+	for _, key := range []string{"disk_driver", "nic_driver"} {
+		models := brandDiskModels
+		if key == "nic_driver" {
+			models = brandNICModels
+		}
+
+		if driver, ok := d.GetOk(key); ok && !stringInSlice(driver.(string), models[brand]) {
+			return fmt.Errorf("%s %s is not supported by brand %s, use one of %s", key, driver, brand, strings.Join(models[brand], ", "))
+		}
+	}
+
+	for i, dd := range d.Get("disks").([]interface{}) {
+		diskDefinition := dd.(map[string]interface{})
+
+		for key, brands := range brandDiskArguments {
+			if value := diskDefinition[key]; value != "" && value != 0 && !stringInSlice(brand, brands) {
+				return fmt.Errorf("disks.%d.%s is not supported by brand %s, only by %s", i, key, brand, strings.Join(brands, ", "))
+			}
+		}
+
+		if model := diskDefinition["model"].(string); model != "" && !stringInSlice(model, brandDiskModels[brand]) {
+			return fmt.Errorf("disks.%d.model %s is not supported by brand %s, use one of %s", i, model, brand, strings.Join(brandDiskModels[brand], ", "))
+		}
+	}
+
+	for i, nd := range d.Get("nics").([]interface{}) {
+		networkInterfaceDefinition := nd.(map[string]interface{})
+
+		if model := networkInterfaceDefinition["model"].(string); model != "" && !stringInSlice(model, brandNICModels[brand]) {
+			if len(brandNICModels[brand]) == 0 {
+				return fmt.Errorf("nics.%d.model is not supported by brand %s", i, brand)
+			}
+			return fmt.Errorf("nics.%d.model %s is not supported by brand %s, use one of %s", i, model, brand, strings.Join(brandNICModels[brand], ", "))
+		}
+	}
+
+	return nil
+}
+
+func stringInSlice(value string, list []string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func resourceMachineCreate(ctx context.Context, d *schema.ResourceData, m interface{}) diag.Diagnostics {
 	log.Printf("---------------- MachineCreate")
 	d.SetId("")
 
@@ -470,46 +840,72 @@ func resourceMachineCreate(d *schema.ResourceData, m interface{}) error {
 	machine := Machine{}
 	err := machine.LoadFromSchema(d)
 	if err != nil {
-		return err
+		return diag.FromErr(err)
 	}
 
-	uuid, err := client.CreateMachine(machine.NodeName, &machine)
+	uuid, err := client.CreateMachine(ctx, machine.NodeName, &machine)
 	if err != nil {
-		return err
+		return diag.FromErr(err)
 	}
 
 	d.SetId(createId(machine.NodeName, *uuid))
 
-	err = resourceMachineRead(d, m)
+	if d.Get("state").(string) == "stopped" {
+		err = client.StopMachine(ctx, machine.NodeName, *uuid)
+		if err != nil {
+			return diag.FromErr(err)
+		}
+	} else {
+		gates := ReadinessGates{
+			Running: d.Get("wait_for_running").(bool),
+			Port:    d.Get("wait_for_port").(int),
+		}
+		for _, key := range d.Get("wait_for_metadata").([]interface{}) {
+			gates.Metadata = append(gates.Metadata, key.(string))
+		}
+
+		err = client.waitForMachineReady(ctx, machine.NodeName, *uuid, &gates)
+		if err != nil {
+			return diag.FromErr(err)
+		}
+	}
+
+	diags := resourceMachineRead(ctx, d, m)
 	log.Printf("---------------- MachineCreate (COMPLETE)")
-	return err
+	return diags
 }
 
-func resourceMachineRead(d *schema.ResourceData, m interface{}) error {
+func resourceMachineRead(ctx context.Context, d *schema.ResourceData, m interface{}) diag.Diagnostics {
 	log.Printf("---------------- MachineRead")
 	client := m.(*SmartOSClient)
 	nodeName, uuid, err := parseId(d.Id())
 	if err != nil {
 		log.Printf("Failed to parse incoming ID [%s] - %s", d.Id(), err)
-		return err
+		return diag.FromErr(err)
+	}
+
+	machine, err := client.GetMachine(ctx, nodeName, uuid)
+	if errors.Is(err, ErrNotFound) && !d.IsNewResource() {
+		log.Printf("Machine with ID %s no longer exists, removing it from state", d.Id())
+		d.SetId("")
+		return nil
 	}
 
-	machine, err := client.GetMachine(nodeName, uuid)
 	if err != nil {
 		log.Printf("Failed to retrieve machine with ID %s.  Error: %s", d.Id(), err)
-		return err
+		return diag.FromErr(err)
 	}
 
 	err = machine.SaveToSchema(d)
 	log.Printf("---------------- MachineRead (COMPLETE)")
-	return err
+	return diag.FromErr(err)
 }
 
-func resourceMachineUpdate(d *schema.ResourceData, m interface{}) error {
+func resourceMachineUpdate(ctx context.Context, d *schema.ResourceData, m interface{}) diag.Diagnostics {
 	log.Printf("---------------- MachineUpdate")
 	nodeName, machineId, err := parseId(d.Id())
 	if err != nil {
-		return err
+		return diag.FromErr(err)
 	}
 
 	d.Partial(true)
@@ -535,6 +931,20 @@ func resourceMachineUpdate(d *schema.ResourceData, m interface{}) error {
 		updatesRequired = true
 	}
 
+	if d.HasChange("bhyve_extra_opts") && !d.IsNewResource() {
+		_, newValue := d.GetChange("bhyve_extra_opts")
+
+		machineUpdate.BhyveExtraOpts = newValue.(string)
+		updatesRequired = true
+	}
+
+	if d.HasChange("bootrom") && !d.IsNewResource() {
+		_, newValue := d.GetChange("bootrom")
+
+		machineUpdate.Bootrom = newValue.(string)
+		updatesRequired = true
+	}
+
 	if d.HasChange("cpu_cap") && !d.IsNewResource() {
 		_, newValue := d.GetChange("cpu_cap")
 
@@ -542,6 +952,76 @@ func resourceMachineUpdate(d *schema.ResourceData, m interface{}) error {
 		updatesRequired = true
 	}
 
+	if d.HasChange("cpu_type") && !d.IsNewResource() {
+		_, newValue := d.GetChange("cpu_type")
+
+		machineUpdate.CPUType = newValue.(string)
+		updatesRequired = true
+	}
+
+	if d.HasChange("disk_driver") && !d.IsNewResource() {
+		_, newValue := d.GetChange("disk_driver")
+
+		machineUpdate.DiskDriver = newValue.(string)
+		updatesRequired = true
+	}
+
+	if d.HasChange("firewall_enabled") && !d.IsNewResource() {
+		_, newValue := d.GetChange("firewall_enabled")
+
+		machineUpdate.FirewallEnabled = newBool(newValue.(bool))
+		updatesRequired = true
+	}
+
+	if d.HasChange("indestructible_delegated") && !d.IsNewResource() {
+		_, newValue := d.GetChange("indestructible_delegated")
+
+		machineUpdate.IndestructibleDelegated = newBool(newValue.(bool))
+		updatesRequired = true
+	}
+
+	if d.HasChange("indestructible_zoneroot") && !d.IsNewResource() {
+		_, newValue := d.GetChange("indestructible_zoneroot")
+
+		machineUpdate.IndestructibleZoneRoot = newBool(newValue.(bool))
+		updatesRequired = true
+	}
+
+	if d.HasChange("flexible_disk_size") && !d.IsNewResource() {
+		_, newValue := d.GetChange("flexible_disk_size")
+
+		machineUpdate.FlexibleDiskSize = newUint32(uint32(newValue.(int)))
+		updatesRequired = true
+	}
+
+	if d.HasChange("nic_driver") && !d.IsNewResource() {
+		_, newValue := d.GetChange("nic_driver")
+
+		machineUpdate.NICDriver = newValue.(string)
+		updatesRequired = true
+	}
+
+	if d.HasChange("vga") && !d.IsNewResource() {
+		_, newValue := d.GetChange("vga")
+
+		machineUpdate.VGA = newValue.(string)
+		updatesRequired = true
+	}
+
+	if d.HasChange("vnc_password") && !d.IsNewResource() {
+		_, newValue := d.GetChange("vnc_password")
+
+		machineUpdate.VNCPassword = newValue.(string)
+		updatesRequired = true
+	}
+
+	if d.HasChange("vnc_port") && !d.IsNewResource() {
+		_, newValue := d.GetChange("vnc_port")
+
+		machineUpdate.VNCPort = newInt32(int32(newValue.(int)))
+		updatesRequired = true
+	}
+
 	if d.HasChange("customer_metadata") && !d.IsNewResource() {
 		oldSchemaValue, newSchemaValue := d.GetChange("customer_metadata")
 		oldMap := oldSchemaValue.(map[string]interface{})
@@ -555,6 +1035,46 @@ func resourceMachineUpdate(d *schema.ResourceData, m interface{}) error {
 		}
 	}
 
+	if d.HasChange("hostname") && !d.IsNewResource() {
+		_, newValue := d.GetChange("hostname")
+
+		machineUpdate.Hostname = newValue.(string)
+		updatesRequired = true
+	}
+
+	if d.HasChange("internal_metadata") && !d.IsNewResource() {
+		oldSchemaValue, newSchemaValue := d.GetChange("internal_metadata")
+		oldMap := oldSchemaValue.(map[string]interface{})
+		newMap := newSchemaValue.(map[string]interface{})
+
+		var addItem func(key string, value interface{}) = machineUpdate.setInternalMetadata
+		var removeItem func(key string) = machineUpdate.removeInternalMetadata
+
+		if ReconcileMaps(oldMap, newMap, addItem, addItem, removeItem, stringsAreEqual) {
+			updatesRequired = true
+		}
+	}
+
+	if d.HasChange("internal_metadata_namespaces") && !d.IsNewResource() {
+		_, newSchemaValue := d.GetChange("internal_metadata_namespaces")
+
+		machineUpdate.InternalMetadataNamespaces = getInternalMetadataNamespaces(newSchemaValue)
+		updatesRequired = true
+	}
+
+	if d.HasChange("routes") && !d.IsNewResource() {
+		oldSchemaValue, newSchemaValue := d.GetChange("routes")
+		oldMap := oldSchemaValue.(map[string]interface{})
+		newMap := newSchemaValue.(map[string]interface{})
+
+		var addItem func(key string, value interface{}) = machineUpdate.setRoute
+		var removeItem func(key string) = machineUpdate.removeRoute
+
+		if ReconcileMaps(oldMap, newMap, addItem, addItem, removeItem, stringsAreEqual) {
+			updatesRequired = true
+		}
+	}
+
 	if d.HasChange("maintain_resolvers") && !d.IsNewResource() {
 		_, newValue := d.GetChange("maintain_resolvers")
 
@@ -588,39 +1108,150 @@ func resourceMachineUpdate(d *schema.ResourceData, m interface{}) error {
 	}
 
 	if d.HasChange("nics") && !d.IsNewResource() {
-		_, newSchemaValue := d.GetChange("nics")
+		oldSchemaValue, newSchemaValue := d.GetChange("nics")
 
-		var nics []NetworkInterface
-		for _, nic := range newSchemaValue.([]interface{}) {
-			nics = append(nics, nic.(NetworkInterface))
+		if machineUpdate.reconcileNetworkInterfaces(oldSchemaValue.([]interface{}), newSchemaValue.([]interface{})) {
+			updatesRequired = true
+		}
+	}
+
+	if d.HasChange("filesystems") && !d.IsNewResource() {
+		oldSchemaValue, newSchemaValue := d.GetChange("filesystems")
+
+		if machineUpdate.reconcileFilesystems(oldSchemaValue.([]interface{}), newSchemaValue.([]interface{})) {
+			updatesRequired = true
 		}
-		machineUpdate.NetworkInterfaces = nics
-		updatesRequired = true
 	}
 
+	diskChanges := false
+	if d.HasChange("disks") && !d.IsNewResource() {
+		oldSchemaValue, newSchemaValue := d.GetChange("disks")
+
+		if machineUpdate.reconcileDisks(oldSchemaValue.([]interface{}), newSchemaValue.([]interface{})) {
+			updatesRequired = true
+			diskChanges = true
+		}
+	}
+
+	client := m.(*SmartOSClient)
+	state := d.Get("state").(string)
+
 	if updatesRequired {
-		client := m.(*SmartOSClient)
+		// Disk changes to a running machine only take effect once it boots again, so the
+		// machine can be stopped for them.
+		restart := false
+		if diskChanges && d.Get("stop_for_disk_changes").(bool) {
+			machine, err := client.GetMachine(ctx, nodeName, machineId)
+			if err != nil {
+				return diag.FromErr(err)
+			}
+
+			if machine.State == "running" {
+				err = client.StopMachine(ctx, nodeName, machineId)
+				if err != nil {
+					return diag.FromErr(err)
+				}
+				restart = state != "stopped"
+			}
+		}
+
+		err = client.UpdateMachine(ctx, nodeName, &machineUpdate)
+
+		if restart {
+			startErr := client.StartMachine(ctx, nodeName, machineId)
+			if err == nil {
+				err = startErr
+			}
+		}
 
-		err = client.UpdateMachine(nodeName, &machineUpdate)
 		if err != nil {
-			return err
+			return diag.FromErr(err)
+		}
+	}
+
+	if d.HasChange("state") && !d.IsNewResource() {
+		err = setMachineState(ctx, client, nodeName, machineId, state)
+		if err != nil {
+			return diag.FromErr(err)
+		}
+	} else if d.HasChange("reboot_triggers") && !d.IsNewResource() && state == "running" {
+		err = client.RebootMachine(ctx, nodeName, machineId)
+		if err != nil {
+			return diag.FromErr(err)
 		}
 	}
 
 	d.Partial(false)
-	err = resourceMachineRead(d, m)
+	diags := resourceMachineRead(ctx, d, m)
 	log.Printf("---------------- MachineUpdate (COMPLETE)")
-	return err
+	return diags
+}
+
+// setMachineState starts or stops the machine unless it is already in the given state.
+func setMachineState(ctx context.Context, client *SmartOSClient, nodeName string, machineId uuid.UUID, state string) error {
+	machine, err := client.GetMachine(ctx, nodeName, machineId)
+	if err != nil {
+		return err
+	}
+
+	if machine.State == state {
+		return nil
+	}
+
+	if state == "stopped" {
+		return client.StopMachine(ctx, nodeName, machineId)
+	}
+
+	return client.StartMachine(ctx, nodeName, machineId)
 }
 
-func resourceMachineDelete(d *schema.ResourceData, m interface{}) error {
+func resourceMachineDelete(ctx context.Context, d *schema.ResourceData, m interface{}) diag.Diagnostics {
 	log.Printf("Request to delete machine with ID: %s\n", d.Id())
 
 	client := m.(*SmartOSClient)
 	nodeName, machineId, err := parseId(d.Id())
 	if err != nil {
-		return err
+		return diag.FromErr(err)
 	}
 
-	return client.DeleteMachine(nodeName, machineId)
+	if protection := indestructibleProperties(d); len(protection) > 0 {
+		return indestructibleDiagnostics(d.Id(), protection)
+	}
+
+	err = client.DeleteMachine(ctx, nodeName, machineId)
+	if errors.Is(err, ErrNotFound) {
+		log.Printf("Machine with ID %s was already deleted", d.Id())
+		return nil
+	}
+
+	// The protection was turned on after the machine was last read.
+	if err != nil && strings.Contains(err.Error(), "indestructible_") {
+		return indestructibleDiagnostics(d.Id(), indestructiblePattern.FindAllString(err.Error(), -1))
+	}
+
+	return diag.FromErr(err)
+}
+
+// indestructibleProperties returns the indestructible flags set on the machine, which make
+// vmadm refuse to delete it.
+func indestructibleProperties(d *schema.ResourceData) []string {
+	var properties []string
+	for _, key := range []string{"indestructible_zoneroot", "indestructible_delegated"} {
+		if d.Get(key).(bool) {
+			properties = append(properties, key)
+		}
+	}
+
+	return properties
+}
+
+func indestructibleDiagnostics(id string, properties []string) diag.Diagnostics {
+	return diag.Diagnostics{
+		{
+			Severity: diag.Error,
+			Summary:  fmt.Sprintf("machine %s is indestructible", id),
+			Detail: fmt.Sprintf("vmadm refuses to delete a machine with %s set.  Set %s to false and apply "+
+				"before destroying or replacing the machine.", strings.Join(properties, " or "), strings.Join(properties, " and ")),
+		},
+	}
 }
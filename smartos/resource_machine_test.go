@@ -0,0 +1,1559 @@
+package smartos
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/resource"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/terraform"
+)
+
+func testAccMachineConfig(f *fakeSmartOS, alias string, metadata string) string {
+	return f.ProviderConfig() + fmt.Sprintf(`
+resource "smartos_machine" "test" {
+  node_name  = "node1"
+  alias      = %q
+  brand      = "joyent"
+  image_uuid = %q
+  ram        = 256
+
+  customer_metadata = {
+    "role" = %q
+  }
+
+  nics {
+    interface = "net0"
+    nic_tag   = "admin"
+    ips       = ["10.0.0.10/24"]
+    gateways  = ["10.0.0.1"]
+  }
+}
+`, alias, testImage.UUID, metadata)
+}
+
+// testAccMachineAttributesConfig returns the configuration of a machine of the brand with the
+// attributes. Zones are created from the test image; bhyve and kvm machines boot from a disk of
+// it, which any disks in the attributes follow.
+func testAccMachineAttributesConfig(f *fakeSmartOS, brand string, attributes string) string {
+	image := fmt.Sprintf("image_uuid = %q", testImage.UUID)
+	if brand == "bhyve" || brand == "kvm" {
+		image = fmt.Sprintf(`ram = 1024
+
+  disks {
+    boot       = true
+    image_uuid = %q
+    size       = 10240
+  }`, testImage.UUID)
+	}
+
+	return f.ProviderConfig() + fmt.Sprintf(`
+resource "smartos_machine" "test" {
+  node_name = "node1"
+  alias     = "test"
+  brand     = %q
+  %s
+
+%s
+}
+`, brand, image, attributes)
+}
+
+// testAccMachineTest runs the steps against f with the test image available for import.
+func testAccMachineTest(t *testing.T, f *fakeSmartOS, steps ...resource.TestStep) {
+	f.AddAvailableImage(testImage)
+
+	resource.Test(t, resource.TestCase{
+		ProviderFactories: testProviderFactories,
+		CheckDestroy:      testAccCheckMachineDestroy(f),
+		Steps:             steps,
+	})
+}
+
+func testAccCheckMachineDestroy(f *fakeSmartOS) resource.TestCheckFunc {
+	return func(s *terraform.State) error {
+		for _, rs := range s.RootModule().Resources {
+			if rs.Type != "smartos_machine" {
+				continue
+			}
+
+			_, id, err := parseId(rs.Primary.ID)
+			if err != nil {
+				return err
+			}
+
+			if f.Machine(id.String()) != nil {
+				return fmt.Errorf("machine %s still exists", rs.Primary.ID)
+			}
+		}
+
+		return nil
+	}
+}
+
+func testAccCheckMachineAlias(f *fakeSmartOS, name string, alias string) resource.TestCheckFunc {
+	return func(s *terraform.State) error {
+		rs, ok := s.RootModule().Resources[name]
+		if !ok {
+			return fmt.Errorf("%s not found in state", name)
+		}
+
+		_, id, err := parseId(rs.Primary.ID)
+		if err != nil {
+			return err
+		}
+
+		vm := f.Machine(id.String())
+		if vm == nil {
+			return fmt.Errorf("machine %s does not exist", rs.Primary.ID)
+		}
+
+		if vm["alias"] != alias {
+			return fmt.Errorf("alias of %s is %v, want %s", rs.Primary.ID, vm["alias"], alias)
+		}
+
+		return nil
+	}
+}
+
+func TestAccMachine_basic(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+	f.AddAvailableImage(testImage)
+
+	resource.Test(t, resource.TestCase{
+		ProviderFactories: testProviderFactories,
+		CheckDestroy:      testAccCheckMachineDestroy(f),
+		Steps: []resource.TestStep{
+			{
+				Config: testAccMachineConfig(f, "web", "frontend"),
+				Check: resource.ComposeTestCheckFunc(
+					testAccCheckMachineAlias(f, "smartos_machine.test", "web"),
+					resource.TestCheckResourceAttr("smartos_machine.test", "primary_ip", "10.0.0.10"),
+					resource.TestCheckResourceAttr("smartos_machine.test", "node_name", "node1"),
+				),
+			},
+			{
+				Config: testAccMachineConfig(f, "web-renamed", "backend"),
+				Check: resource.ComposeTestCheckFunc(
+					testAccCheckMachineAlias(f, "smartos_machine.test", "web-renamed"),
+					resource.TestCheckResourceAttr("smartos_machine.test", "customer_metadata.role", "backend"),
+				),
+			},
+		},
+	})
+}
+
+func TestAccMachine_transientFailures(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+	f.AddAvailableImage(testImage)
+
+	resource.Test(t, resource.TestCase{
+		ProviderFactories: testProviderFactories,
+		CheckDestroy:      testAccCheckMachineDestroy(f),
+		Steps: []resource.TestStep{
+			{
+				PreConfig: func() {
+					f.FailSlowly("vmadm get", 2*time.Second, 1)
+					f.Fail("imgadm import", fakeFailExit, "imgadm import: error: failed to acquire lock\n", 1)
+				},
+				Config: testAccMachineConfig(f, "web", "frontend"),
+				Check:  testAccCheckMachineAlias(f, "smartos_machine.test", "web"),
+			},
+			{
+				PreConfig: func() {
+					f.DropConnections()
+					f.Fail("vmadm update", fakeFailExit, "Failed to update VM: zone is busy\n", 2)
+				},
+				Config: testAccMachineConfig(f, "web-renamed", "frontend"),
+				Check:  testAccCheckMachineAlias(f, "smartos_machine.test", "web-renamed"),
+			},
+		},
+	})
+}
+
+func TestAccMachine_badJSON(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+	f.AddAvailableImage(testImage)
+
+	resource.Test(t, resource.TestCase{
+		ProviderFactories: testProviderFactories,
+		CheckDestroy:      testAccCheckMachineDestroy(f),
+		Steps: []resource.TestStep{
+			{
+				PreConfig: func() {
+					f.Fail("vmadm get", fakeFailBadJSON, "", 1)
+				},
+				Config:      testAccMachineConfig(f, "web", "frontend"),
+				ExpectError: regexp.MustCompile("unexpected end of JSON input"),
+			},
+		},
+	})
+}
+
+func TestAccMachine_createFailure(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+
+	resource.Test(t, resource.TestCase{
+		ProviderFactories: testProviderFactories,
+		CheckDestroy:      testAccCheckMachineDestroy(f),
+		Steps: []resource.TestStep{
+			{
+				// The image is neither installed nor available.
+				Config:      testAccMachineConfig(f, "web", "frontend"),
+				ExpectError: regexp.MustCompile("ActiveImageNotFound"),
+			},
+		},
+	})
+}
+
+func TestResourceMachine_lifecycle(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+	f.AddInstalledImage(testImage)
+
+	client := testClient(t, f, nil)
+	defer client.Close()
+	ctx := context.Background()
+
+	d := schema.TestResourceDataRaw(t, resourceMachine().Schema, map[string]interface{}{
+		"node_name":  "node1",
+		"alias":      "web",
+		"brand":      "joyent",
+		"image_uuid": testImage.UUID,
+		"customer_metadata": map[string]interface{}{
+			"role": "frontend",
+		},
+		"nics": []interface{}{
+			map[string]interface{}{
+				"interface": "net0",
+				"nic_tag":   "admin",
+				"ips":       []interface{}{"10.0.0.10/24"},
+			},
+		},
+	})
+
+	if diags := resourceMachineCreate(ctx, d, client); diags.HasError() {
+		t.Fatal(diags)
+	}
+
+	if !strings.HasPrefix(d.Id(), "node1/") {
+		t.Errorf("ID = %q, want node1/<uuid>", d.Id())
+	}
+
+	if ip := d.Get("primary_ip").(string); ip != "10.0.0.10" {
+		t.Errorf("primary_ip = %q, want 10.0.0.10", ip)
+	}
+
+	_, id, err := parseId(d.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm := f.Machine(id.String())
+	if metadata := vm["customer_metadata"].(map[string]interface{}); metadata["role"] != "frontend" {
+		t.Errorf("customer_metadata = %v, want role=frontend", metadata)
+	}
+
+	if diags := resourceMachineDelete(ctx, d, client); diags.HasError() {
+		t.Fatal(diags)
+	}
+
+	if f.Machine(id.String()) != nil {
+		t.Errorf("machine still exists after delete")
+	}
+}
+
+func TestResourceMachine_readMissing(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+
+	client := testClient(t, f, nil)
+	defer client.Close()
+	ctx := context.Background()
+
+	d := resourceMachine().TestResourceData()
+	d.SetId("node1/2d6d1f0a-5b39-4b5b-a2a4-1b9c3c2d1e0f")
+
+	if diags := resourceMachineRead(ctx, d, client); diags.HasError() {
+		t.Fatal(diags)
+	}
+
+	if d.Id() != "" {
+		t.Errorf("ID = %q, want it cleared for a machine that no longer exists", d.Id())
+	}
+}
+
+func TestResourceMachine_deleteIndestructible(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+	id := f.AddMachine(map[string]interface{}{"brand": "joyent", "alias": "database", "indestructible_zoneroot": true})
+
+	client := testClient(t, f, nil)
+	defer client.Close()
+
+	d := schema.TestResourceDataRaw(t, resourceMachine().Schema, map[string]interface{}{
+		"node_name":               "node1",
+		"brand":                   "joyent",
+		"indestructible_zoneroot": true,
+	})
+	d.SetId("node1/" + id)
+
+	diags := resourceMachineDelete(context.Background(), d, client)
+	if !diags.HasError() || diags[0].Summary != "machine node1/"+id+" is indestructible" {
+		t.Fatalf("diagnostics = %+v, want the machine reported as indestructible", diags)
+	}
+
+	if !strings.Contains(diags[0].Detail, "with indestructible_zoneroot set.  Set indestructible_zoneroot to false") {
+		t.Errorf("detail = %q, want it to name indestructible_zoneroot", diags[0].Detail)
+	}
+
+	if count := f.CommandCount("vmadm delete"); count != 0 || f.Machine(id) == nil {
+		t.Errorf("vmadm delete ran %d times, want the machine left alone", count)
+	}
+
+	diags = indestructibleDiagnostics("node1/"+id, []string{"indestructible_zoneroot", "indestructible_delegated"})
+	if want := "with indestructible_zoneroot or indestructible_delegated set.  Set indestructible_zoneroot and indestructible_delegated to false"; !strings.Contains(diags[0].Detail, want) {
+		t.Errorf("detail = %q, want it to contain %q", diags[0].Detail, want)
+	}
+}
+
+func TestSetMachineState(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+	id := f.AddMachine(map[string]interface{}{"brand": "joyent", "alias": "test"})
+
+	client := testClient(t, f, nil)
+	defer client.Close()
+	ctx := context.Background()
+
+	for _, step := range []struct {
+		state string
+		stops int
+		start int
+	}{
+		{state: "stopped", stops: 1},
+		// A machine already in the state is left alone.
+		{state: "stopped", stops: 1},
+		{state: "running", stops: 1, start: 1},
+	} {
+		if err := setMachineState(ctx, client, "node1", uuid.MustParse(id), step.state); err != nil {
+			t.Fatal(err)
+		}
+
+		if state := f.Machine(id)["state"]; state != step.state {
+			t.Errorf("state = %v, want %s", state, step.state)
+		}
+
+		if stops, starts := f.CommandCount("vmadm stop"), f.CommandCount("vmadm start"); stops != step.stops || starts != step.start {
+			t.Errorf("vmadm stop ran %d and start %d times, want %d and %d", stops, starts, step.stops, step.start)
+		}
+	}
+}
+
+func TestResourceMachineCustomizeDiff_hostname(t *testing.T) {
+	for _, tc := range []struct {
+		brand       string
+		requiresNew bool
+	}{
+		{brand: "joyent", requiresNew: true},
+		{brand: "lx", requiresNew: true},
+		{brand: "bhyve"},
+		{brand: "kvm"},
+	} {
+		t.Run(tc.brand, func(t *testing.T) {
+			state := &terraform.InstanceState{
+				ID: "node1/2d6d1f0a-5b39-4b5b-a2a4-1b9c3c2d1e0f",
+				Attributes: map[string]string{
+					"id":        "node1/2d6d1f0a-5b39-4b5b-a2a4-1b9c3c2d1e0f",
+					"node_name": "node1",
+					"alias":     "test",
+					"brand":     tc.brand,
+					"hostname":  "old",
+				},
+			}
+
+			config := terraform.NewResourceConfigRaw(map[string]interface{}{
+				"node_name": "node1",
+				"alias":     "test",
+				"brand":     tc.brand,
+				"hostname":  "new",
+			})
+
+			diff, err := resourceMachine().Diff(context.Background(), state, config, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			hostname, ok := diff.Attributes["hostname"]
+			if !ok || hostname.New != "new" {
+				t.Fatalf("hostname diff = %+v, want a change to new", hostname)
+			}
+
+			if hostname.RequiresNew != tc.requiresNew {
+				t.Errorf("hostname requires a new machine: %t, want %t", hostname.RequiresNew, tc.requiresNew)
+			}
+		})
+	}
+}
+
+func TestValidateRoutes(t *testing.T) {
+	valid := map[string]interface{}{
+		"10.10.0.0/16":    "10.0.0.1",
+		"192.168.1.1":     "nics[1]",
+		"fd00::/8":        "fe80::1",
+		"0.0.0.0/0":       "nics[0]",
+		"172.16.0.0/12":   "172.16.0.1",
+		"2001:db8::1":     "2001:db8::fffe",
+		"198.51.100.0/24": "nics[10]",
+	}
+
+	if _, errs := validateRoutes(valid, "routes"); len(errs) != 0 {
+		t.Errorf("unexpected errors %v", errs)
+	}
+
+	for _, tc := range []struct {
+		destination string
+		gateway     string
+		err         string
+	}{
+		{destination: "10.10.0.0/33", gateway: "10.0.0.1", err: `routes: "10.10.0.0/33" is not an IP address or subnet`},
+		{destination: "example.com", gateway: "10.0.0.1", err: `routes: "example.com" is not an IP address or subnet`},
+		{destination: "10.10.0.0/16", gateway: "gateway", err: `routes.10.10.0.0/16: "gateway" is not a gateway address or nics[n]`},
+		{destination: "10.10.0.0/16", gateway: "nics[a]", err: `routes.10.10.0.0/16: "nics[a]" is not a gateway address or nics[n]`},
+		{destination: "10.10.0.0/16", gateway: "net0", err: `routes.10.10.0.0/16: "net0" is not a gateway address or nics[n]`},
+	} {
+		_, errs := validateRoutes(map[string]interface{}{tc.destination: tc.gateway}, "routes")
+		if len(errs) != 1 || errs[0].Error() != tc.err {
+			t.Errorf("%s => %s: errors = %v, want %q", tc.destination, tc.gateway, errs, tc.err)
+		}
+	}
+}
+
+func TestResourceMachine_deleteMissing(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+
+	client := testClient(t, f, nil)
+	defer client.Close()
+	ctx := context.Background()
+
+	d := resourceMachine().TestResourceData()
+	d.SetId("node1/2d6d1f0a-5b39-4b5b-a2a4-1b9c3c2d1e0f")
+
+	if diags := resourceMachineDelete(ctx, d, client); diags.HasError() {
+		t.Fatal(diags)
+	}
+}
+
+func TestAccMachine_disappears(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+	f.AddAvailableImage(testImage)
+
+	deleteMachine := func(s *terraform.State) error {
+		_, id, err := parseId(s.RootModule().Resources["smartos_machine.test"].Primary.ID)
+		if err != nil {
+			return err
+		}
+
+		f.DeleteMachine(id.String())
+		return nil
+	}
+
+	resource.Test(t, resource.TestCase{
+		ProviderFactories: testProviderFactories,
+		CheckDestroy:      testAccCheckMachineDestroy(f),
+		Steps: []resource.TestStep{
+			{
+				Config:             testAccMachineConfig(f, "web", "frontend"),
+				Check:              deleteMachine,
+				ExpectNonEmptyPlan: true,
+			},
+			{
+				Config: testAccMachineConfig(f, "web", "frontend"),
+				Check:  testAccCheckMachineAlias(f, "smartos_machine.test", "web"),
+			},
+		},
+	})
+}
+
+func TestAccMachine_import(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+	f.AddAvailableImage(testImage)
+
+	resource.Test(t, resource.TestCase{
+		ProviderFactories: testProviderFactories,
+		CheckDestroy:      testAccCheckMachineDestroy(f),
+		Steps: []resource.TestStep{
+			{
+				Config: testAccMachineConfig(f, "web", "frontend"),
+			},
+			{
+				Config:            testAccMachineConfig(f, "web", "frontend"),
+				ResourceName:      "smartos_machine.test",
+				ImportState:       true,
+				ImportStateVerify: true,
+			},
+			{
+				Config:            testAccMachineConfig(f, "web", "frontend"),
+				ResourceName:      "smartos_machine.test",
+				ImportState:       true,
+				ImportStateId:     "node1/web",
+				ImportStateVerify: true,
+			},
+		},
+	})
+}
+
+func TestAccMachine_importExisting(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+	f.AddInstalledImage(testImage)
+
+	id := f.AddMachine(map[string]interface{}{
+		"alias":               "db",
+		"brand":               "joyent",
+		"image_uuid":          testImage.UUID,
+		"max_physical_memory": 2048,
+		"quota":               50,
+		"cpu_cap":             200,
+		"customer_metadata": map[string]interface{}{
+			"role":                 "database",
+			"terraform:ready":      "true",
+			"root_authorized_keys": "ssh-ed25519 AAAA",
+		},
+		"nics": []interface{}{
+			map[string]interface{}{
+				"interface": "net0",
+				"nic_tag":   "external",
+				"ip":        "192.168.1.20",
+				"netmask":   "255.255.255.0",
+				"gateways":  []interface{}{"192.168.1.1"},
+				"vlan_id":   12,
+			},
+		},
+	})
+
+	resource.Test(t, resource.TestCase{
+		ProviderFactories: testProviderFactories,
+		Steps: []resource.TestStep{
+			{
+				Config:        f.ProviderConfig() + `resource "smartos_machine" "db" {}`,
+				ResourceName:  "smartos_machine.db",
+				ImportState:   true,
+				ImportStateId: "node1/db",
+				ImportStateCheck: func(states []*terraform.InstanceState) error {
+					if len(states) != 1 {
+						return fmt.Errorf("imported %d resources, want 1", len(states))
+					}
+
+					want := map[string]string{
+						"id":                                     "node1/" + id,
+						"node_name":                              "node1",
+						"alias":                                  "db",
+						"brand":                                  "joyent",
+						"image_uuid":                             testImage.UUID,
+						"ram":                                    "2048",
+						"max_physical_memory":                    "2048",
+						"quota":                                  "50",
+						"cpu_cap":                                "200",
+						"autoboot":                               "true",
+						"customer_metadata.role":                 "database",
+						"customer_metadata.%":                    "2",
+						"metadata.ready":                         "true",
+						"nics.#":                                 "1",
+						"nics.0.ips.0":                           "192.168.1.20/24",
+						"nics.0.nic_tag":                         "external",
+						"nics.0.gateways.0":                      "192.168.1.1",
+						"nics.0.vlan_id":                         "12",
+						"primary_ip":                             "192.168.1.20",
+						"customer_metadata.root_authorized_keys": "ssh-ed25519 AAAA",
+					}
+
+					for key, value := range want {
+						if actual := states[0].Attributes[key]; actual != value {
+							return fmt.Errorf("%s = %q, want %q", key, actual, value)
+						}
+					}
+
+					return nil
+				},
+			},
+		},
+	})
+}
+
+func TestResourceMachineImport(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+
+	web := f.AddMachine(map[string]interface{}{"brand": "joyent", "alias": "web"})
+	f.AddMachine(map[string]interface{}{"brand": "joyent", "alias": "worker"})
+	f.AddMachine(map[string]interface{}{"brand": "joyent", "alias": "worker"})
+
+	client := testClient(t, f, nil)
+	defer client.Close()
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		id   string
+		want string
+		err  string
+	}{
+		{id: "node1/" + web, want: "node1/" + web},
+		{id: "node1/web", want: "node1/" + web},
+		{id: "node1/missing", err: "no machine with alias missing"},
+		{id: "node1/worker", err: "import by UUID instead"},
+		{id: web, err: "expected node_name/uuid or node_name/alias"},
+	} {
+		d := resourceMachine().TestResourceData()
+		d.SetId(tc.id)
+
+		result, err := resourceMachineImport(ctx, d, client)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("import %s: error = %v, want %q", tc.id, err, tc.err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("import %s: %s", tc.id, err)
+			continue
+		}
+
+		if result[0].Id() != tc.want {
+			t.Errorf("import %s: ID = %s, want %s", tc.id, result[0].Id(), tc.want)
+		}
+	}
+}
+
+func testAccChangeMachine(f *fakeSmartOS, name string, changes map[string]interface{}) func() {
+	return func() {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+
+		for _, vm := range f.machines {
+			if vm["alias"] != name {
+				continue
+			}
+
+			for key, value := range changes {
+				if key == "customer_metadata" {
+					metadata := vm[key].(map[string]interface{})
+					for k, v := range value.(map[string]interface{}) {
+						metadata[k] = v
+					}
+					continue
+				}
+				vm[key] = value
+			}
+		}
+	}
+}
+
+func TestAccMachine_drift(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+
+	config := testAccMachineAttributesConfig(f, "joyent", `
+  ram       = 512
+  cpu_cap   = 100
+  quota     = 20
+  resolvers = ["10.0.0.2", "10.0.0.3"]
+
+  customer_metadata = {
+    "role" = "frontend"
+  }
+
+  nics {
+    interface = "net0"
+    nic_tag   = "admin"
+    ips       = ["10.0.0.10/24"]
+  }
+`)
+
+	testAccMachineTest(t, f,
+		resource.TestStep{
+			Config: config,
+		},
+		resource.TestStep{
+			// Changes made with vmadm update on the node show up in the plan.
+			PreConfig: testAccChangeMachine(f, "test", map[string]interface{}{
+				"cpu_cap":   400,
+				"quota":     100,
+				"resolvers": []interface{}{"8.8.8.8"},
+				"customer_metadata": map[string]interface{}{
+					"role":  "backend",
+					"extra": "added by hand",
+				},
+			}),
+			Config:             config,
+			PlanOnly:           true,
+			ExpectNonEmptyPlan: true,
+		},
+		resource.TestStep{
+			// Applying the configuration again corrects them.
+			Config: config,
+			Check: resource.ComposeTestCheckFunc(
+				resource.TestCheckResourceAttr("smartos_machine.test", "cpu_cap", "100"),
+				resource.TestCheckResourceAttr("smartos_machine.test", "quota", "20"),
+				resource.TestCheckResourceAttr("smartos_machine.test", "resolvers.#", "2"),
+				resource.TestCheckResourceAttr("smartos_machine.test", "customer_metadata.%", "1"),
+				resource.TestCheckResourceAttr("smartos_machine.test", "customer_metadata.role", "frontend"),
+				testAccCheckMachineProperty(f, "test", "cpu_cap", float64(100)),
+				testAccCheckMachineProperty(f, "test", "quota", float64(20)),
+			),
+		},
+		resource.TestStep{
+			// Keys the guest publishes and changes to the memory cap of a zone do not
+			// cause changes.
+			PreConfig: testAccChangeMachine(f, "test", map[string]interface{}{
+				"max_physical_memory": 1024,
+				"customer_metadata": map[string]interface{}{
+					"terraform:ready": "true",
+				},
+			}),
+			Config:   config,
+			PlanOnly: true,
+		},
+	)
+}
+
+func testAccCheckMachineProperty(f *fakeSmartOS, alias string, key string, value interface{}) resource.TestCheckFunc {
+	return func(s *terraform.State) error {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+
+		for _, vm := range f.machines {
+			if vm["alias"] == alias {
+				if !reflect.DeepEqual(vm[key], value) {
+					return fmt.Errorf("%s of %s is %v (%T), want %v (%T)", key, alias, vm[key], vm[key], value, value)
+				}
+				return nil
+			}
+		}
+
+		return fmt.Errorf("machine %s does not exist", alias)
+	}
+}
+
+func TestMachineSaveToSchema_guestAddresses(t *testing.T) {
+	machine := Machine{
+		NodeName: "node1",
+		Brand:    "joyent",
+		NetworkInterfaces: []NetworkInterface{
+			{Interface: "net0", IPAddresses: []string{"dhcp"}, IPAddress: "dhcp", IsPrimary: newBool(true)},
+			{Interface: "net1", IPAddresses: []string{"10.0.0.10/24"}, IPAddress: "10.0.0.10"},
+		},
+		CustomerMetadata: map[string]string{
+			"role":            "frontend",
+			"terraform:ready": "true",
+		},
+	}
+
+	machine.UpdatePrimaryIP()
+	machine.UpdateMetadata()
+
+	d := resourceMachine().TestResourceData()
+	if err := machine.SaveToSchema(d); err != nil {
+		t.Fatal(err)
+	}
+
+	if ip := d.Get("primary_ip").(string); ip != "" {
+		t.Errorf("primary_ip = %q, want no address for a DHCP NIC", ip)
+	}
+
+	if ips := d.Get("nics.0.ips").([]interface{}); len(ips) != 1 || ips[0] != "dhcp" {
+		t.Errorf("nics.0.ips = %v, want [dhcp]", ips)
+	}
+
+	if metadata := d.Get("customer_metadata").(map[string]interface{}); len(metadata) != 1 {
+		t.Errorf("customer_metadata = %v, want only role", metadata)
+	}
+
+	if ready := d.Get("metadata.ready").(string); ready != "true" {
+		t.Errorf("metadata.ready = %q, want true", ready)
+	}
+}
+
+func TestMachineSaveToSchema_delegatedDataset(t *testing.T) {
+	id := uuid.MustParse("2d6d1f0a-5b39-4b5b-a2a4-1b9c3c2d1e0f")
+
+	for _, tc := range []struct {
+		datasets []string
+		want     bool
+	}{
+		{datasets: []string{"zones/" + id.String() + "/data"}, want: true},
+		{datasets: []string{"zones/" + uuid.New().String() + "/data"}, want: false},
+		{datasets: nil, want: false},
+	} {
+		machine := Machine{ID: &id, NodeName: "node1", Brand: "joyent", Datasets: tc.datasets}
+
+		d := resourceMachine().TestResourceData()
+		if err := machine.SaveToSchema(d); err != nil {
+			t.Fatal(err)
+		}
+
+		if delegated := d.Get("delegate_dataset").(bool); delegated != tc.want {
+			t.Errorf("datasets %v: delegate_dataset = %t, want %t", tc.datasets, delegated, tc.want)
+		}
+	}
+}
+
+func testAccCheckMachineID(name string, id *string) resource.TestCheckFunc {
+	return func(s *terraform.State) error {
+		rs, ok := s.RootModule().Resources[name]
+		if !ok {
+			return fmt.Errorf("%s not found in state", name)
+		}
+
+		if *id == "" {
+			*id = rs.Primary.ID
+		} else if *id != rs.Primary.ID {
+			return fmt.Errorf("%s was replaced: ID changed from %s to %s", name, *id, rs.Primary.ID)
+		}
+
+		return nil
+	}
+}
+
+func TestAccMachine_nics(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+
+	var id string
+
+	testAccMachineTest(t, f,
+		resource.TestStep{
+			Config: testAccMachineAttributesConfig(f, "joyent", `
+  nics {
+    interface = "net0"
+    nic_tag   = "admin"
+    ips       = ["10.0.0.10/24"]
+  }`),
+			Check: resource.ComposeTestCheckFunc(
+				testAccCheckMachineID("smartos_machine.test", &id),
+				resource.TestCheckResourceAttr("smartos_machine.test", "nics.0.primary", "true"),
+				resource.TestCheckResourceAttrSet("smartos_machine.test", "nics.0.mac"),
+			),
+		},
+		resource.TestStep{
+			// Add a NIC and change the addresses of the existing one.
+			Config: testAccMachineAttributesConfig(f, "joyent", `
+  nics {
+    interface         = "net0"
+    nic_tag           = "admin"
+    ips               = ["10.0.0.11/24"]
+    gateways          = ["10.0.0.1"]
+    allow_ip_spoofing = true
+  }
+
+  nics {
+    interface = "net1"
+    nic_tag   = "storage"
+    ips       = ["192.168.10.5/24"]
+  }`),
+			Check: resource.ComposeTestCheckFunc(
+				testAccCheckMachineID("smartos_machine.test", &id),
+				resource.TestCheckResourceAttr("smartos_machine.test", "nics.#", "2"),
+				resource.TestCheckResourceAttr("smartos_machine.test", "nics.0.ips.0", "10.0.0.11/24"),
+				resource.TestCheckResourceAttr("smartos_machine.test", "nics.0.allow_ip_spoofing", "true"),
+				resource.TestCheckResourceAttr("smartos_machine.test", "nics.1.nic_tag", "storage"),
+				resource.TestCheckResourceAttr("smartos_machine.test", "primary_ip", "10.0.0.11"),
+			),
+		},
+		resource.TestStep{
+			// A NIC added as primary takes the flag over in one apply.
+			Config: testAccMachineAttributesConfig(f, "joyent", `
+  nics {
+    interface         = "net0"
+    nic_tag           = "admin"
+    ips               = ["10.0.0.11/24"]
+    gateways          = ["10.0.0.1"]
+    allow_ip_spoofing = true
+  }
+
+  nics {
+    interface = "net1"
+    nic_tag   = "storage"
+    ips       = ["192.168.10.5/24"]
+  }
+
+  nics {
+    interface = "net2"
+    nic_tag   = "external"
+    ips       = ["172.16.0.5/24"]
+    primary   = true
+  }`),
+			Check: resource.ComposeTestCheckFunc(
+				testAccCheckMachineID("smartos_machine.test", &id),
+				resource.TestCheckResourceAttr("smartos_machine.test", "nics.#", "3"),
+				resource.TestCheckResourceAttr("smartos_machine.test", "nics.0.primary", "false"),
+				resource.TestCheckResourceAttr("smartos_machine.test", "nics.2.primary", "true"),
+				resource.TestCheckResourceAttr("smartos_machine.test", "primary_ip", "172.16.0.5"),
+			),
+		},
+		resource.TestStep{
+			// Remove the first NIC and make the remaining one primary.
+			Config: testAccMachineAttributesConfig(f, "joyent", `
+  nics {
+    interface = "net1"
+    nic_tag   = "storage"
+    ips       = ["192.168.10.5/24"]
+    primary   = true
+  }`),
+			Check: resource.ComposeTestCheckFunc(
+				testAccCheckMachineID("smartos_machine.test", &id),
+				resource.TestCheckResourceAttr("smartos_machine.test", "nics.#", "1"),
+				resource.TestCheckResourceAttr("smartos_machine.test", "nics.0.interface", "net1"),
+				resource.TestCheckResourceAttr("smartos_machine.test", "primary_ip", "192.168.10.5"),
+			),
+		},
+	)
+}
+
+func TestAccMachine_disks(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+
+	var id string
+
+	// The disks follow the boot disk of the test image.
+	testAccMachineTest(t, f,
+		resource.TestStep{
+			Config: testAccMachineAttributesConfig(f, "bhyve", `
+  disks {
+    size = 20480
+  }`),
+			Check: resource.ComposeTestCheckFunc(
+				testAccCheckMachineID("smartos_machine.test", &id),
+				resource.TestCheckResourceAttr("smartos_machine.test", "disks.#", "2"),
+				resource.TestCheckResourceAttrSet("smartos_machine.test", "disks.1.path"),
+			),
+		},
+		resource.TestStep{
+			// Grow the data disk and attach another one.
+			Config: testAccMachineAttributesConfig(f, "bhyve", `
+  disks {
+    size = 40960
+  }
+
+  disks {
+    size = 5120
+  }`),
+			Check: resource.ComposeTestCheckFunc(
+				testAccCheckMachineID("smartos_machine.test", &id),
+				resource.TestCheckResourceAttr("smartos_machine.test", "disks.#", "3"),
+				resource.TestCheckResourceAttr("smartos_machine.test", "disks.1.size", "40960"),
+				resource.TestCheckResourceAttr("smartos_machine.test", "disks.2.size", "5120"),
+			),
+		},
+		resource.TestStep{
+			Config: testAccMachineAttributesConfig(f, "bhyve", `
+  disks {
+    size = 20480
+  }
+
+  disks {
+    size = 5120
+  }`),
+			ExpectError: regexp.MustCompile("cannot shrink disk"),
+		},
+		resource.TestStep{
+			// Removing the data disk would leave the last disk on its path.
+			Config: testAccMachineAttributesConfig(f, "bhyve", `
+  disks {
+    size = 5120
+  }`),
+			ExpectError: regexp.MustCompile("cannot change disk .* while disks are removed"),
+		},
+		resource.TestStep{
+			// Detach the last disk, stopping the machine around the change.
+			PreConfig: func() {
+				if count := f.CommandCount("vmadm stop"); count != 0 {
+					t.Errorf("vmadm stop ran %d times without stop_for_disk_changes", count)
+				}
+			},
+			Config: testAccMachineAttributesConfig(f, "bhyve", `
+  stop_for_disk_changes = true
+
+  disks {
+    size = 40960
+  }`),
+			Check: resource.ComposeTestCheckFunc(
+				testAccCheckMachineID("smartos_machine.test", &id),
+				resource.TestCheckResourceAttr("smartos_machine.test", "disks.#", "2"),
+				testAccCheckMachineProperty(f, "test", "state", "running"),
+				testAccCheckCommandCount(f, "vmadm stop", 1),
+				testAccCheckCommandCount(f, "vmadm start", 1),
+			),
+		},
+	)
+}
+
+func TestAccMachine_bhyve(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+
+	var id string
+
+	testAccMachineTest(t, f,
+		resource.TestStep{
+			Config: testAccMachineAttributesConfig(f, "bhyve", `
+  bootrom     = "uefi"
+  disk_driver = "virtio"
+  vnc_port    = 5901
+`),
+			Check: resource.ComposeTestCheckFunc(
+				testAccCheckMachineID("smartos_machine.test", &id),
+				resource.TestCheckResourceAttr("smartos_machine.test", "bootrom", "uefi"),
+				resource.TestCheckResourceAttr("smartos_machine.test", "vnc_port", "5901"),
+				testAccCheckMachineProperty(f, "test", "disk_driver", "virtio"),
+			),
+		},
+		resource.TestStep{
+			Config: testAccMachineAttributesConfig(f, "bhyve", `
+  bootrom            = "bios"
+  bhyve_extra_opts   = "-c sockets=1,cores=2"
+  disk_driver        = "virtio"
+  flexible_disk_size = 51200
+  vnc_port           = 5902
+  vnc_password       = "hunter2"
+`),
+			Check: resource.ComposeTestCheckFunc(
+				testAccCheckMachineID("smartos_machine.test", &id),
+				testAccCheckMachineProperty(f, "test", "bootrom", "bios"),
+				testAccCheckMachineProperty(f, "test", "bhyve_extra_opts", "-c sockets=1,cores=2"),
+				testAccCheckMachineProperty(f, "test", "flexible_disk_size", float64(51200)),
+				testAccCheckMachineProperty(f, "test", "vnc_port", float64(5902)),
+				resource.TestCheckResourceAttr("smartos_machine.test", "vnc_password", "hunter2"),
+			),
+		},
+		resource.TestStep{
+			Config:      testAccMachineAttributesConfig(f, "bhyve", `cpu_type = "host"`),
+			ExpectError: regexp.MustCompile("cpu_type is not supported by brand bhyve, only by kvm"),
+		},
+		resource.TestStep{
+			Config:      testAccMachineAttributesConfig(f, "bhyve", `disk_driver = "ide"`),
+			ExpectError: regexp.MustCompile("disk_driver ide is not supported by brand bhyve"),
+		},
+	)
+}
+
+func TestAccMachine_brandArguments(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+
+	testAccMachineTest(t, f,
+		resource.TestStep{
+			Config:      testAccMachineAttributesConfig(f, "joyent", `vnc_port = 5901`),
+			PlanOnly:    true,
+			ExpectError: regexp.MustCompile("vnc_port is not supported by brand joyent"),
+		},
+		resource.TestStep{
+			Config: testAccMachineAttributesConfig(f, "joyent", `
+  nics {
+    interface = "net0"
+    nic_tag   = "admin"
+    ips       = ["dhcp"]
+    model     = "virtio"
+  }`),
+			PlanOnly:    true,
+			ExpectError: regexp.MustCompile("nics.0.model is not supported by brand joyent"),
+		},
+	)
+}
+
+func testAccCheckCommandCount(f *fakeSmartOS, prefix string, want int) resource.TestCheckFunc {
+	return func(*terraform.State) error {
+		if count := f.CommandCount(prefix); count != want {
+			return fmt.Errorf("%s ran %d times, want %d", prefix, count, want)
+		}
+		return nil
+	}
+}
+
+func TestAccMachine_state(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+
+	config := func(state string, trigger string) string {
+		return testAccMachineAttributesConfig(f, "joyent", fmt.Sprintf(`
+  state = %q
+
+  reboot_triggers = {
+    config = %q
+  }
+`, state, trigger))
+	}
+
+	testAccMachineTest(t, f,
+		resource.TestStep{
+			Config: config("stopped", "v1"),
+			Check: resource.ComposeTestCheckFunc(
+				resource.TestCheckResourceAttr("smartos_machine.test", "state", "stopped"),
+				testAccCheckMachineProperty(f, "test", "state", "stopped"),
+			),
+		},
+		resource.TestStep{
+			// Changing the triggers of a stopped machine does not reboot it.
+			Config: config("stopped", "v2"),
+			Check:  testAccCheckCommandCount(f, "vmadm reboot", 0),
+		},
+		resource.TestStep{
+			Config: config("running", "v2"),
+			Check: resource.ComposeTestCheckFunc(
+				resource.TestCheckResourceAttr("smartos_machine.test", "state", "running"),
+				testAccCheckCommandCount(f, "vmadm start", 1),
+				testAccCheckCommandCount(f, "vmadm reboot", 0),
+			),
+		},
+		resource.TestStep{
+			Config: config("running", "v3"),
+			Check:  testAccCheckCommandCount(f, "vmadm reboot", 1),
+		},
+		resource.TestStep{
+			// A machine stopped on the node is started again.
+			PreConfig: testAccChangeMachine(f, "test", map[string]interface{}{"state": "stopped"}),
+			Config:    config("running", "v3"),
+			Check: resource.ComposeTestCheckFunc(
+				testAccCheckMachineProperty(f, "test", "state", "running"),
+				testAccCheckCommandCount(f, "vmadm start", 2),
+			),
+		},
+	)
+}
+
+func TestAccMachine_waitForReady(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+	f.SimulateBoot(500*time.Millisecond, map[string]string{"terraform:ready": "true"})
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	testAccMachineTest(t, f,
+		resource.TestStep{
+			Config: testAccMachineAttributesConfig(f, "joyent", fmt.Sprintf(`
+  wait_for_running  = true
+  wait_for_port     = %d
+  wait_for_metadata = ["ready"]
+
+  nics {
+    interface = "net0"
+    nic_tag   = "admin"
+    ips       = ["127.0.0.1/8"]
+  }
+`, listener.Addr().(*net.TCPAddr).Port)),
+			Check: resource.ComposeTestCheckFunc(
+				resource.TestCheckResourceAttr("smartos_machine.test", "state", "running"),
+				resource.TestCheckResourceAttr("smartos_machine.test", "metadata.ready", "true"),
+			),
+		},
+	)
+}
+
+func TestAccMachine_waitForReadyTimeout(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+
+	testAccMachineTest(t, f,
+		resource.TestStep{
+			Config: testAccMachineAttributesConfig(f, "joyent", `
+  wait_for_metadata = ["ready"]
+
+  timeouts {
+    create = "2s"
+  }
+`),
+			ExpectError: regexp.MustCompile("did not become ready before the create timeout: waiting for the guest to publish metadata ready"),
+		},
+	)
+}
+
+func TestAccMachine_createTimeout(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+	f.FailSlowly("imgadm import", time.Minute, 1)
+
+	testAccMachineTest(t, f,
+		resource.TestStep{
+			Config: testAccMachineAttributesConfig(f, "joyent", `
+  timeouts {
+    create = "1s"
+  }
+`),
+			ExpectError: regexp.MustCompile("context deadline exceeded"),
+		},
+	)
+}
+
+func TestAccMachine_indestructible(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+
+	config := func(delegateDataset bool, indestructible bool) string {
+		return testAccMachineAttributesConfig(f, "joyent", fmt.Sprintf(`
+  delegate_dataset         = %t
+  indestructible_delegated = %t
+  indestructible_zoneroot  = %t
+`, delegateDataset, indestructible, indestructible))
+	}
+
+	testAccMachineTest(t, f,
+		resource.TestStep{
+			Config: config(true, true),
+			Check: resource.ComposeTestCheckFunc(
+				resource.TestCheckResourceAttr("smartos_machine.test", "delegate_dataset", "true"),
+				testAccCheckMachineProperty(f, "test", "indestructible_delegated", true),
+				testAccCheckMachineProperty(f, "test", "indestructible_zoneroot", true),
+			),
+		},
+		resource.TestStep{
+			Config:      f.ProviderConfig(),
+			ExpectError: regexp.MustCompile(`(?s)is indestructible.*Set indestructible_zoneroot and\s+indestructible_delegated to false`),
+		},
+		resource.TestStep{
+			Config:      config(false, true),
+			ExpectError: regexp.MustCompile("indestructible_delegated requires delegate_dataset"),
+		},
+		resource.TestStep{
+			Config: config(true, false),
+			Check: resource.ComposeTestCheckFunc(
+				resource.TestCheckResourceAttr("smartos_machine.test", "indestructible_zoneroot", "false"),
+				testAccCheckMachineProperty(f, "test", "indestructible_delegated", nil),
+				testAccCheckMachineProperty(f, "test", "indestructible_zoneroot", nil),
+			),
+		},
+		resource.TestStep{
+			ResourceName:      "smartos_machine.test",
+			ImportState:       true,
+			ImportStateVerify: true,
+		},
+	)
+}
+
+func testAccCheckMachineFilesystems(f *fakeSmartOS, alias string, want map[string]string) resource.TestCheckFunc {
+	return func(s *terraform.State) error {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+
+		for _, vm := range f.machines {
+			if vm["alias"] != alias {
+				continue
+			}
+
+			filesystems, _ := vm["filesystems"].([]interface{})
+			got := map[string]string{}
+			for _, fs := range filesystems {
+				filesystem := fs.(map[string]interface{})
+				var options []string
+				values, _ := filesystem["options"].([]interface{})
+				for _, option := range values {
+					options = append(options, option.(string))
+				}
+				got[filesystem["target"].(string)] = fmt.Sprintf("%s %s %s", filesystem["type"], filesystem["source"], strings.Join(options, ","))
+			}
+
+			if !reflect.DeepEqual(got, want) {
+				return fmt.Errorf("filesystems of %s are %v, want %v", alias, got, want)
+			}
+			return nil
+		}
+
+		return fmt.Errorf("machine %s does not exist", alias)
+	}
+}
+
+func TestAccMachine_filesystems(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+
+	var id string
+
+	testAccMachineTest(t, f,
+		resource.TestStep{
+			Config: testAccMachineAttributesConfig(f, "joyent", `
+  filesystems {
+    source  = "/opt/certs"
+    target  = "/etc/certs"
+    options = ["ro", "nodevice"]
+  }
+
+  filesystems {
+    source  = "/net/nas/share"
+    target  = "/data"
+    options = ["nodevice"]
+  }
+`),
+			Check: resource.ComposeTestCheckFunc(
+				testAccCheckMachineID("smartos_machine.test", &id),
+				resource.TestCheckResourceAttr("smartos_machine.test", "filesystems.0.type", "lofs"),
+				testAccCheckMachineFilesystems(f, "test", map[string]string{
+					"/etc/certs": "lofs /opt/certs ro,nodevice",
+					"/data":      "lofs /net/nas/share nodevice",
+				}),
+			),
+		},
+		resource.TestStep{
+			// A changed filesystem is removed and added again.
+			Config: testAccMachineAttributesConfig(f, "joyent", `
+  filesystems {
+    source  = "/opt/certs"
+    target  = "/etc/certs"
+    options = ["rw", "nodevice"]
+  }
+
+  filesystems {
+    source = "/var/log/proxy"
+    target = "/var/log/nginx"
+  }
+`),
+			Check: resource.ComposeTestCheckFunc(
+				testAccCheckMachineID("smartos_machine.test", &id),
+				testAccCheckMachineFilesystems(f, "test", map[string]string{
+					"/etc/certs":     "lofs /opt/certs rw,nodevice",
+					"/var/log/nginx": "lofs /var/log/proxy ",
+				}),
+			),
+		},
+		resource.TestStep{
+			ResourceName:      "smartos_machine.test",
+			ImportState:       true,
+			ImportStateVerify: true,
+		},
+		resource.TestStep{
+			Config: testAccMachineAttributesConfig(f, "joyent", `
+  filesystems {
+    source = "/opt/certs"
+    target = "/etc/certs"
+  }
+
+  filesystems {
+    source = "/opt/other"
+    target = "/etc/certs"
+  }
+`),
+			ExpectError: regexp.MustCompile("filesystems.1: more than one filesystem is mounted on /etc/certs"),
+		},
+		resource.TestStep{
+			Config: testAccMachineAttributesConfig(f, "joyent", ""),
+			Check: resource.ComposeTestCheckFunc(
+				testAccCheckMachineID("smartos_machine.test", &id),
+				resource.TestCheckResourceAttr("smartos_machine.test", "filesystems.#", "0"),
+				testAccCheckMachineFilesystems(f, "test", map[string]string{}),
+			),
+		},
+	)
+}
+
+func TestAccMachine_routes(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+
+	var id string
+
+	routes := testAccMachineAttributesConfig(f, "joyent", `
+  routes = {
+    "10.10.0.0/16" = "192.168.1.254"
+    "10.20.0.0/16" = "192.168.1.1"
+  }
+`)
+
+	testAccMachineTest(t, f,
+		resource.TestStep{
+			Config: testAccMachineAttributesConfig(f, "joyent", `
+  routes = {
+    "10.10.0.0/16" = "192.168.1.1"
+    "172.16.5.5"   = "nics[1]"
+  }
+`),
+			Check: resource.ComposeTestCheckFunc(
+				testAccCheckMachineID("smartos_machine.test", &id),
+				testAccCheckMachineProperty(f, "test", "routes", map[string]interface{}{
+					"10.10.0.0/16": "192.168.1.1",
+					"172.16.5.5":   "nics[1]",
+				}),
+			),
+		},
+		resource.TestStep{
+			Config: routes,
+			Check: resource.ComposeTestCheckFunc(
+				testAccCheckMachineID("smartos_machine.test", &id),
+				testAccCheckMachineProperty(f, "test", "routes", map[string]interface{}{
+					"10.10.0.0/16": "192.168.1.254",
+					"10.20.0.0/16": "192.168.1.1",
+				}),
+				resource.TestCheckResourceAttr("smartos_machine.test", "routes.%", "2"),
+			),
+		},
+		resource.TestStep{
+			// A route removed on the node is restored.
+			PreConfig: testAccChangeMachine(f, "test", map[string]interface{}{
+				"routes": map[string]interface{}{"10.10.0.0/16": "192.168.1.254"},
+			}),
+			Config: routes,
+			Check: testAccCheckMachineProperty(f, "test", "routes", map[string]interface{}{
+				"10.10.0.0/16": "192.168.1.254",
+				"10.20.0.0/16": "192.168.1.1",
+			}),
+		},
+		resource.TestStep{
+			ResourceName:      "smartos_machine.test",
+			ImportState:       true,
+			ImportStateVerify: true,
+		},
+	)
+}
+
+func TestAccMachine_internalMetadata(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+
+	var id string
+
+	testAccMachineTest(t, f,
+		resource.TestStep{
+			Config: testAccMachineAttributesConfig(f, "joyent", `
+  internal_metadata = {
+    "docker:cmd"     = "[\"/bin/sh\"]"
+    "operator:token" = "s3cret"
+  }
+  internal_metadata_namespaces = ["operator"]
+`),
+			Check: resource.ComposeTestCheckFunc(
+				testAccCheckMachineID("smartos_machine.test", &id),
+				testAccCheckMachineProperty(f, "test", "internal_metadata", map[string]interface{}{
+					"docker:cmd":     `["/bin/sh"]`,
+					"operator:token": "s3cret",
+				}),
+				testAccCheckMachineProperty(f, "test", "internal_metadata_namespaces", []interface{}{"operator"}),
+			),
+		},
+		resource.TestStep{
+			Config: testAccMachineAttributesConfig(f, "joyent", `
+  internal_metadata = {
+    "operator:token" = "r0tated"
+    "operator:url"   = "https://operator.example.com"
+  }
+  internal_metadata_namespaces = []
+`),
+			Check: resource.ComposeTestCheckFunc(
+				testAccCheckMachineID("smartos_machine.test", &id),
+				testAccCheckMachineProperty(f, "test", "internal_metadata", map[string]interface{}{
+					"operator:token": "r0tated",
+					"operator:url":   "https://operator.example.com",
+				}),
+				testAccCheckMachineProperty(f, "test", "internal_metadata_namespaces", []interface{}{}),
+			),
+		},
+		resource.TestStep{
+			ResourceName:      "smartos_machine.test",
+			ImportState:       true,
+			ImportStateVerify: true,
+		},
+	)
+}
+
+func TestAccMachine_hostname(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+
+	var id string
+
+	config := func(hostname string, gateway string, resolver string) string {
+		return testAccMachineAttributesConfig(f, "joyent", fmt.Sprintf(`
+  hostname           = %q
+  dns_domain         = "example.com"
+  maintain_resolvers = true
+  resolvers          = [%q]
+
+  nics {
+    interface = "net0"
+    nic_tag   = "admin"
+    ips       = ["10.0.0.10/24"]
+    gateways  = [%q]
+  }
+`, hostname, resolver, gateway))
+	}
+
+	testAccMachineTest(t, f,
+		resource.TestStep{
+			Config:      config("mail01", "10.0.0.256", "ns1.example.com"),
+			ExpectError: regexp.MustCompile(`(?s)expected resolvers.0 to contain a valid IP, got: ns1.example.com.*expected nics.0.gateways.0 to contain a valid IP, got: 10.0.0.256`),
+		},
+		resource.TestStep{
+			Config: config("mail01", "10.0.0.1", "10.0.0.2"),
+			Check: resource.ComposeTestCheckFunc(
+				testAccCheckMachineID("smartos_machine.test", &id),
+				testAccCheckMachineProperty(f, "test", "hostname", "mail01"),
+				testAccCheckMachineProperty(f, "test", "dns_domain", "example.com"),
+			),
+		},
+		resource.TestStep{
+			// Resolvers changed on the node are corrected.
+			PreConfig: testAccChangeMachine(f, "test", map[string]interface{}{
+				"maintain_resolvers": false,
+				"resolvers":          []interface{}{"8.8.8.8"},
+			}),
+			Config: config("mail01", "10.0.0.1", "10.0.0.2"),
+			Check: resource.ComposeTestCheckFunc(
+				testAccCheckMachineID("smartos_machine.test", &id),
+				testAccCheckMachineProperty(f, "test", "maintain_resolvers", true),
+				testAccCheckMachineProperty(f, "test", "resolvers", []interface{}{"10.0.0.2"}),
+			),
+		},
+		resource.TestStep{
+			// Zones only take their host name when they are created.
+			Config: config("mail02", "10.0.0.1", "10.0.0.2"),
+			Check: resource.ComposeTestCheckFunc(
+				func(s *terraform.State) error {
+					if s.RootModule().Resources["smartos_machine.test"].Primary.ID == id {
+						return fmt.Errorf("machine was not replaced")
+					}
+					return nil
+				},
+				testAccCheckMachineProperty(f, "test", "hostname", "mail02"),
+			),
+		},
+	)
+}
+
+func TestAccMachine_hostnameBhyve(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+
+	var id string
+
+	testAccMachineTest(t, f,
+		resource.TestStep{
+			Config: testAccMachineAttributesConfig(f, "bhyve", `hostname = "vm01"`),
+			Check:  testAccCheckMachineID("smartos_machine.test", &id),
+		},
+		resource.TestStep{
+			// Hardware virtualized machines get their host name from DHCP, so it is
+			// changed in place.
+			Config: testAccMachineAttributesConfig(f, "bhyve", `hostname = "vm02"`),
+			Check: resource.ComposeTestCheckFunc(
+				testAccCheckMachineID("smartos_machine.test", &id),
+				testAccCheckMachineProperty(f, "test", "hostname", "vm02"),
+			),
+		},
+	)
+}
@@ -0,0 +1,101 @@
+package smartos
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"regexp"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// RetryPolicy describes how operations that failed for transient reasons are retried.
+type RetryPolicy struct {
+	MaxRetries     int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// transientCommandErrors matches vmadm and imgadm errors caused by another operation holding
+// a lock or the node being temporarily overloaded.
+var transientCommandErrors = regexp.MustCompile(`(?i)(resource temporarily unavailable|EAGAIN|EBUSY|device busy|is busy|failed to (acquire|obtain|get) lock|lock .*held|timed out waiting for)`)
+
+// Do runs operation until it succeeds, fails permanently, runs out of retries or the context
+// is done.  Operations that are not idempotent are only retried when they failed before the
+// remote command started, since a lost connection leaves it unknown whether the command took
+// effect.
+func (p *RetryPolicy) Do(ctx context.Context, description string, idempotent bool, operation func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := operation()
+		if err == nil || attempt >= p.MaxRetries || ctx.Err() != nil || !isRetryable(err, idempotent) {
+			return err
+		}
+
+		delay := p.backoff(attempt)
+		log.Printf("%s failed (%s), retrying in %s (retry %d of %d)", description, err, delay, attempt+1, p.MaxRetries)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// backoff returns the delay before the given retry: exponential growth capped at MaxBackoff,
+// with the upper half randomized so that parallel operations do not retry in lockstep.
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.InitialBackoff
+	for i := 0; i < attempt && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+
+	if delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+
+	if delay <= 0 {
+		return 0
+	}
+
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+func isRetryable(err error, idempotent bool) bool {
+	var sessionError *SessionError
+	if errors.As(err, &sessionError) {
+		var rejectedError *ConnectRejectedError
+		return !errors.As(err, &rejectedError)
+	}
+
+	if !idempotent {
+		return false
+	}
+
+	if errors.Is(err, ErrBusy) {
+		return true
+	}
+
+	var commandError *CommandError
+	if !errors.As(err, &commandError) {
+		return false
+	}
+
+	// Failed vmadm commands are classified by classifyVmadmError but imgadm ones are not.
+	if commandExited(commandError) {
+		return transientCommandErrors.MatchString(commandError.Stderr)
+	}
+
+	// Anything other than a clean exit status means the connection was lost while the
+	// command ran.
+	var exitMissingError *ssh.ExitMissingError
+	var netError net.Error
+	return errors.As(commandError.Err, &exitMissingError) ||
+		errors.As(commandError.Err, &netError) ||
+		errors.Is(commandError.Err, io.EOF)
+}
@@ -0,0 +1,49 @@
+package smartos
+
+import "context"
+
+// semaphore limits the number of concurrent operations.  A nil semaphore is unlimited.
+type semaphore chan struct{}
+
+func newSemaphore(size int) semaphore {
+	if size <= 0 {
+		return nil
+	}
+
+	return make(semaphore, size)
+}
+
+// TryAcquire takes a slot if one is free without waiting.
+func (s semaphore) TryAcquire() bool {
+	if s == nil {
+		return true
+	}
+
+	select {
+	case s <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Acquire waits until a slot is free and takes it, or until the context is done.
+func (s semaphore) Acquire(ctx context.Context) error {
+	if s == nil {
+		return nil
+	}
+
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Release frees a slot taken by Acquire or TryAcquire.
+func (s semaphore) Release() {
+	if s != nil {
+		<-s
+	}
+}
@@ -1,93 +1,97 @@
 package smartos
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"regexp"
+	"strings"
 
 	"github.com/google/uuid"
-	"golang.org/x/crypto/ssh"
 )
 
 type SmartOSClient struct {
-	hosts           map[string]interface{}
-	user            string
-	clients         map[string]*ssh.Client
+	hosts           map[string]*Host
+	executors       map[string]Executor
+	pool            *ConnectionPool
+	retryPolicy     *RetryPolicy
 	agentConnection net.Conn
-	authMethods     []ssh.AuthMethod
 }
 
-func (c *SmartOSClient) Connect(nodeName string) error {
-	var err error = nil
+// Close closes every connection held by the client, including the SSH agent connection.
+func (c *SmartOSClient) Close() {
+	c.pool.Close()
 
-	if c.clients[nodeName] != nil {
-		return nil
+	if c.agentConnection != nil {
+		c.agentConnection.Close()
+		c.agentConnection = nil
 	}
+}
 
-	config := &ssh.ClientConfig{
-		User:            c.user,
-		Auth:            c.authMethods,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+// run runs a command, given as an argument vector, on the node with the node's executor,
+// retrying transient failures.  The command is killed when the context is done.
+func (c *SmartOSClient) run(ctx context.Context, nodeName string, args []string, stdin []byte, idempotent bool) ([]byte, []byte, error) {
+	executor, ok := c.executors[nodeName]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown node %s; it must be configured in the provider's hosts", nodeName)
 	}
 
-	log.Printf("SSH: Connecting to host: %s at %s", nodeName, c.hosts[nodeName].(string))
-	connectString := fmt.Sprintf("%s:22", c.hosts[nodeName].(string))
-	client, err := ssh.Dial("tcp", connectString, config)
-	if err != nil {
-		log.Println("SSH: Connection failed: ", err.Error())
+	var stdout, stderr []byte
+	err := c.retryPolicy.Do(ctx, shellCommand(args), idempotent, func() error {
+		var err error
+		stdout, stderr, err = executor.Run(ctx, args, stdin)
+		if args[0] == "vmadm" || args[0] == "fwadm" {
+			err = classifyVmadmError(err)
+		}
 		return err
-	}
-
-	c.clients[nodeName] = client
+	})
 
-	log.Println("SSH: Connected successfully")
-	return nil
+	return stdout, stderr, err
 }
 
-func (c *SmartOSClient) Close(nodeName string) {
-	if c.clients[nodeName] != nil {
-		c.clients[nodeName].Close()
-		c.clients[nodeName] = nil
+// acquireProvisionSlot waits until the node may start another vmadm create or imgadm import.
+// The returned function frees the slot.
+func (c *SmartOSClient) acquireProvisionSlot(ctx context.Context, nodeName string) (func(), error) {
+	host, ok := c.hosts[nodeName]
+	if !ok {
+		return nil, fmt.Errorf("unknown node %s; it must be configured in the provider's hosts", nodeName)
 	}
-}
-
-func (c *SmartOSClient) CreateMachine(nodeName string, machine *Machine) (*uuid.UUID, error) {
-	log.Printf("Creating machine on node: %s", nodeName)
 
-	err := c.Connect(nodeName)
-	if err != nil {
-		return nil, err
+	if !host.provisions.TryAcquire() {
+		log.Printf("Waiting for other provisioning operations on node %s to finish", nodeName)
+		if err := host.provisions.Acquire(ctx); err != nil {
+			return nil, err
+		}
 	}
 
-	session, err := c.clients[nodeName].NewSession()
-	if err != nil {
-		return nil, err
-	}
+	return host.provisions.Release, nil
+}
 
-	defer session.Close()
+func (c *SmartOSClient) CreateMachine(ctx context.Context, nodeName string, machine *Machine) (*uuid.UUID, error) {
+	log.Printf("Creating machine on node: %s", nodeName)
 
 	// Ensure the image has been imported
 	if machine.ImageUUID != nil && *machine.ImageUUID != uuid.Nil {
 		log.Printf("Ensuring image with UUID %s has been imported", machine.ImageUUID.String())
-		err = c.ImportRemoteImage(nodeName, *machine.ImageUUID)
+		err := c.ImportRemoteImage(ctx, nodeName, *machine.ImageUUID)
 		if err != nil {
-			log.Fatalln("Failed to import image for machine.  Error: ", err.Error())
+			log.Println("Failed to import image for machine.  Error: ", err.Error())
 			return nil, err
 		}
 	} else if machine.Brand == "joyent" || machine.Brand == "lx" {
-		log.Fatalln("No image specifiec for OS VM.")
+		log.Println("No image specifiec for OS VM.")
 		return nil, fmt.Errorf("No image specifiec for OS VM.")
 	}
 
 	// Ensure any disk images are imported
 	for _, disk := range machine.Disks {
 		if disk.ImageUUID != nil && *disk.ImageUUID != uuid.Nil {
-			err = c.ImportRemoteImage(nodeName, *disk.ImageUUID)
+			err := c.ImportRemoteImage(ctx, nodeName, *disk.ImageUUID)
 			if err != nil {
-				log.Fatalf("Failed to import disk image: %s (Error: %s)", disk.ImageUUID.String(), err.Error())
+				log.Printf("Failed to import disk image: %s (Error: %s)", disk.ImageUUID.String(), err.Error())
 				return nil, err
 			}
 		}
@@ -95,24 +99,26 @@ func (c *SmartOSClient) CreateMachine(nodeName string, machine *Machine) (*uuid.
 
 	json, err := json.Marshal(machine)
 	if err != nil {
-		log.Fatalln("Failed to create JSON for machine.  Error: ", err.Error())
+		log.Println("Failed to create JSON for machine.  Error: ", err.Error())
 		return nil, err
 	}
 
-	log.Println("JSON: ", string(json))
+	log.Println("JSON: ", redactMachineJSON(json))
 
-	session.Stdin = bytes.NewReader(json)
+	releaseProvisionSlot, err := c.acquireProvisionSlot(ctx, nodeName)
+	if err != nil {
+		return nil, err
+	}
 
-	var b bytes.Buffer
-	session.Stderr = &b
+	defer releaseProvisionSlot()
 
-	log.Println("SSH execute: vmadm create")
-	err = session.Run("vmadm create")
+	// vmadm create is not idempotent so it is only retried when it never started.
+	_, stderr, err := c.run(ctx, nodeName, []string{"vmadm", "create"}, json, false)
 	if err != nil {
-		return nil, fmt.Errorf("remote command vmadm failed.  Error: %s (%s)", err, b.String())
+		return nil, err
 	}
 
-	output := b.String()
+	output := string(stderr)
 	log.Printf("Returned data: %s", output)
 
 	re := regexp.MustCompile("Successfully created VM ([0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12})")
@@ -131,110 +137,133 @@ func (c *SmartOSClient) CreateMachine(nodeName string, machine *Machine) (*uuid.
 	return &uuid, nil
 }
 
-func (c *SmartOSClient) GetMachine(nodeName string, id uuid.UUID) (*Machine, error) {
-	err := c.Connect(nodeName)
+func (c *SmartOSClient) GetMachine(ctx context.Context, nodeName string, id uuid.UUID) (*Machine, error) {
+	outputBytes, _, err := c.run(ctx, nodeName, []string{"vmadm", "get", id.String()}, nil, true)
 	if err != nil {
 		return nil, err
 	}
 
-	session, err := c.clients[nodeName].NewSession()
+	log.Printf("Returned data: %s", redactMachineJSON(outputBytes))
+
+	var machine Machine
+	err = json.Unmarshal(outputBytes, &machine)
 	if err != nil {
+		log.Printf("Failed to parse returned JSON: %s", err)
 		return nil, err
 	}
 
-	defer session.Close()
+	machine.NodeName = nodeName
+	machine.UpdatePrimaryIP()
+	machine.UpdateMetadata()
 
-	var b bytes.Buffer
-	session.Stdout = &b
+	return &machine, nil
+}
 
-	var stderr bytes.Buffer
-	session.Stderr = &stderr
+// aliasPattern matches the aliases FindMachineByAlias looks up.  vmadm list reads a filter
+// value starting with ~ as a regular expression, which this also rules out.
+var aliasPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
 
-	log.Println("SSH execute: vmadm get", id.String())
-	err = session.Run("vmadm get " + id.String())
-	if err != nil {
-		return nil, fmt.Errorf("remote command vmadm failed.  Error: %s (%s)", err, stderr.String())
+// FindMachineByAlias returns the UUID of the only machine on the node with the given alias.
+func (c *SmartOSClient) FindMachineByAlias(ctx context.Context, nodeName string, alias string) (*uuid.UUID, error) {
+	if !aliasPattern.MatchString(alias) {
+		return nil, fmt.Errorf("invalid alias %q, aliases contain only letters, digits, '_', '.' and '-'", alias)
 	}
 
-	outputBytes := b.Bytes()
+	outputBytes, _, err := c.run(ctx, nodeName, []string{"vmadm", "list", "-p", "-o", "uuid", "alias=" + alias}, nil, true)
+	if err != nil {
+		return nil, err
+	}
 
-	output := string(outputBytes)
+	output := strings.TrimSpace(string(outputBytes))
 	log.Printf("Returned data: %s", output)
 
-	var machine Machine
-	err = json.Unmarshal(outputBytes, &machine)
+	if output == "" {
+		return nil, fmt.Errorf("no machine with alias %s found on node %s", alias, nodeName)
+	}
+
+	ids := strings.Fields(output)
+	if len(ids) > 1 {
+		return nil, fmt.Errorf("alias %s is shared by machines %s on node %s, import by UUID instead", alias, strings.Join(ids, ", "), nodeName)
+	}
+
+	id, err := uuid.Parse(ids[0])
 	if err != nil {
-		log.Printf("Failed to parse returned JSON: %s", err)
 		return nil, err
 	}
 
-	machine.NodeName = nodeName
-	machine.UpdatePrimaryIP()
-	machine.UpdateMetadata()
-
-	return &machine, nil
+	return &id, nil
 }
 
-func (c *SmartOSClient) UpdateMachine(nodeName string, machine *Machine) error {
-	err := c.Connect(nodeName)
+func (c *SmartOSClient) UpdateMachine(ctx context.Context, nodeName string, machine *Machine) error {
+	json, err := json.Marshal(machine)
 	if err != nil {
+		log.Println("Failed to create JSON for machine.  Error: ", err.Error())
 		return err
 	}
 
-	session, err := c.clients[nodeName].NewSession()
-	if err != nil {
-		return err
-	}
+	log.Println("JSON: ", redactMachineJSON(json))
 
-	defer session.Close()
+	// Adding devices cannot be repeated safely after a lost connection, everything else can.
+	idempotent := len(machine.AddNetworkInterfaces) == 0 && len(machine.AddDisks) == 0
 
-	json, err := json.Marshal(machine)
+	_, stderr, err := c.run(ctx, nodeName, []string{"vmadm", "update", machine.ID.String()}, json, idempotent)
 	if err != nil {
-		log.Fatalln("Failed to create JSON for machine.  Error: ", err.Error())
+		return err
 	}
 
-	log.Println("JSON: ", string(json))
+	log.Printf("Returned data: %s", string(stderr))
 
-	session.Stdin = bytes.NewReader(json)
+	return nil
+}
 
-	var b bytes.Buffer
-	session.Stderr = &b
+func (c *SmartOSClient) StopMachine(ctx context.Context, nodeName string, id uuid.UUID) error {
+	log.Printf("Stopping machine %s on node %s", id.String(), nodeName)
 
-	log.Println("SSH execute: vmadm update" + machine.ID.String())
-	err = session.Run("vmadm update " + machine.ID.String())
+	_, stderr, err := c.run(ctx, nodeName, []string{"vmadm", "stop", id.String()}, nil, true)
 	if err != nil {
-		return fmt.Errorf("remote command vmadm failed.  Error: %s (%s)", err, b.String())
+		return err
 	}
 
-	output := b.String()
-	log.Printf("Returned data: %s", output)
+	log.Printf("Returned data: %s", string(stderr))
 
 	return nil
 }
 
-func (c *SmartOSClient) DeleteMachine(nodeName string, id uuid.UUID) error {
-	err := c.Connect(nodeName)
+func (c *SmartOSClient) StartMachine(ctx context.Context, nodeName string, id uuid.UUID) error {
+	log.Printf("Starting machine %s on node %s", id.String(), nodeName)
+
+	_, stderr, err := c.run(ctx, nodeName, []string{"vmadm", "start", id.String()}, nil, true)
 	if err != nil {
 		return err
 	}
 
-	session, err := c.clients[nodeName].NewSession()
+	log.Printf("Returned data: %s", string(stderr))
+
+	return nil
+}
+
+// RebootMachine restarts a running machine.  Running the reboot twice after a lost connection
+// is harmless, so it is retried like the other power operations.
+func (c *SmartOSClient) RebootMachine(ctx context.Context, nodeName string, id uuid.UUID) error {
+	log.Printf("Rebooting machine %s on node %s", id.String(), nodeName)
+
+	_, stderr, err := c.run(ctx, nodeName, []string{"vmadm", "reboot", id.String()}, nil, true)
 	if err != nil {
 		return err
 	}
 
-	defer session.Close()
+	log.Printf("Returned data: %s", string(stderr))
 
-	var b bytes.Buffer
-	session.Stderr = &b
+	return nil
+}
 
-	log.Println("SSH execute: vmadm delete ", id.String())
-	err = session.Run("vmadm delete " + id.String())
+func (c *SmartOSClient) DeleteMachine(ctx context.Context, nodeName string, id uuid.UUID) error {
+	_, stderr, err := c.run(ctx, nodeName, []string{"vmadm", "delete", id.String()}, nil, true)
 	if err != nil {
-		return fmt.Errorf("remote command vmadm failed.  Error: %s", err)
+		return err
 	}
 
-	output := b.String()
+	output := string(stderr)
 	log.Printf("Returned data: %s", output)
 
 	re := regexp.MustCompile("Successfully deleted VM ([0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12})")
@@ -247,96 +276,112 @@ func (c *SmartOSClient) DeleteMachine(nodeName string, id uuid.UUID) error {
 	return nil
 }
 
-func (c *SmartOSClient) GetLocalImage(nodeName string, name string, version string) (*Image, error) {
-	err := c.Connect(nodeName)
+// CreateFirewallRule adds a rule with fwadm.  The rule's UUID is chosen here so that the rule
+// can be found again even when fwadm's output is lost.
+func (c *SmartOSClient) CreateFirewallRule(ctx context.Context, nodeName string, rule *FirewallRule) (*uuid.UUID, error) {
+	id := uuid.New()
+	rule.ID = &id
+
+	payload, err := json.Marshal(map[string][]*FirewallRule{"rules": {rule}})
 	if err != nil {
 		return nil, err
 	}
 
-	session, err := c.clients[nodeName].NewSession()
+	log.Println("JSON: ", string(payload))
+
+	// The rule's UUID is chosen here, so a retried fwadm add that finds the rule already
+	// exists means an earlier attempt added it before the connection was lost.
+	stdout, _, err := c.run(ctx, nodeName, []string{"fwadm", "add", "-f", "-"}, payload, true)
+	if errors.Is(err, ErrAlreadyExists) && strings.Contains(err.Error(), id.String()) {
+		log.Printf("Firewall rule %s was added by an earlier attempt", id)
+		return &id, nil
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	defer session.Close()
+	log.Printf("Returned data: %s", string(stdout))
 
-	var b bytes.Buffer
-	session.Stdout = &b
-
-	var stderr bytes.Buffer
-	session.Stderr = &stderr
+	return &id, nil
+}
 
-	command := fmt.Sprintf("imgadm list -j name=%s version=%s", name, version)
-	err = session.Run(command)
+func (c *SmartOSClient) GetFirewallRule(ctx context.Context, nodeName string, id uuid.UUID) (*FirewallRule, error) {
+	outputBytes, _, err := c.run(ctx, nodeName, []string{"fwadm", "get", id.String()}, nil, true)
 	if err != nil {
-		return nil, fmt.Errorf("remote command vmadm failed.  Error: %s (%s)", err, stderr.String())
+		return nil, err
 	}
 
-	outputBytes := b.Bytes()
+	log.Printf("Returned data: %s", string(outputBytes))
 
-	output := string(outputBytes)
-	log.Printf("Returned data: %s", output)
-
-	var images []map[string]interface{}
-	err = json.Unmarshal(outputBytes, &images)
+	var rule FirewallRule
+	err = json.Unmarshal(outputBytes, &rule)
 	if err != nil {
 		log.Printf("Failed to parse returned JSON: %s", err)
 		return nil, err
 	}
 
-	if len(images) == 0 {
-		return nil, nil
-	}
+	rule.NodeName = nodeName
 
-	imageInfo := images[0]
-	manifest := imageInfo["manifest"].(map[string]interface{})
+	return &rule, nil
+}
 
-	image := Image{}
-	image.Name = manifest["name"].(string)
-	image.Version = manifest["version"].(string)
+func (c *SmartOSClient) UpdateFirewallRule(ctx context.Context, nodeName string, rule *FirewallRule) error {
+	payload, err := json.Marshal(map[string][]*FirewallRule{"rules": {rule}})
+	if err != nil {
+		return err
+	}
 
-	imageID, err := uuid.Parse(manifest["uuid"].(string))
+	log.Println("JSON: ", string(payload))
+
+	stdout, _, err := c.run(ctx, nodeName, []string{"fwadm", "update", "-f", "-"}, payload, true)
 	if err != nil {
-		log.Printf("Failed to parse uuid: %s", err)
-		return nil, err
+		return err
 	}
-	image.ID = &imageID
 
-	return &image, nil
+	log.Printf("Returned data: %s", string(stdout))
+
+	return nil
 }
 
-func (c *SmartOSClient) FindRemoteImage(nodeName string, name string, version string) (*Image, error) {
-	err := c.Connect(nodeName)
+func (c *SmartOSClient) DeleteFirewallRule(ctx context.Context, nodeName string, id uuid.UUID) error {
+	stdout, _, err := c.run(ctx, nodeName, []string{"fwadm", "delete", id.String()}, nil, true)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	session, err := c.clients[nodeName].NewSession()
+	log.Printf("Returned data: %s", string(stdout))
+
+	return nil
+}
+
+func (c *SmartOSClient) GetLocalImage(ctx context.Context, nodeName string, name string, version string) (*Image, error) {
+	command := []string{"imgadm", "list", "-j", "name=" + name, "version=" + version}
+	output, _, err := c.run(ctx, nodeName, command, nil, true)
 	if err != nil {
 		return nil, err
 	}
 
-	defer session.Close()
-
-	var b bytes.Buffer
-	session.Stdout = &b
-
-	var stderr bytes.Buffer
-	session.Stderr = &stderr
+	return parseImageList(output)
+}
 
-	command := fmt.Sprintf("imgadm avail -j name=%s version=%s", name, version)
-	err = session.Run(command)
+func (c *SmartOSClient) FindRemoteImage(ctx context.Context, nodeName string, name string, version string) (*Image, error) {
+	command := []string{"imgadm", "avail", "-j", "name=" + name, "version=" + version}
+	output, _, err := c.run(ctx, nodeName, command, nil, true)
 	if err != nil {
-		return nil, fmt.Errorf("remote command vmadm failed.  Error: %s (%s)", err, stderr.String())
+		return nil, err
 	}
 
-	outputBytes := b.Bytes()
+	return parseImageList(output)
+}
 
+// parseImageList returns the first image of the JSON output of imgadm list or imgadm avail,
+// or nil if there is none.
+func parseImageList(outputBytes []byte) (*Image, error) {
 	output := string(outputBytes)
 	log.Printf("Returned data: %s", output)
 
 	var images []map[string]interface{}
-	err = json.Unmarshal(outputBytes, &images)
+	err := json.Unmarshal(outputBytes, &images)
 	if err != nil {
 		log.Printf("Failed to parse returned JSON: %s", err)
 		return nil, err
@@ -363,54 +408,40 @@ func (c *SmartOSClient) FindRemoteImage(nodeName string, name string, version st
 	return &image, nil
 }
 
-func (c *SmartOSClient) ImportRemoteImage(nodeName string, uuid uuid.UUID) error {
-	err := c.Connect(nodeName)
-	if err != nil {
-		return err
-	}
-
-	session, err := c.clients[nodeName].NewSession()
+func (c *SmartOSClient) ImportRemoteImage(ctx context.Context, nodeName string, uuid uuid.UUID) error {
+	releaseProvisionSlot, err := c.acquireProvisionSlot(ctx, nodeName)
 	if err != nil {
 		return err
 	}
 
-	defer session.Close()
-
-	var b bytes.Buffer
-	session.Stdout = &b
-
-	var stderr bytes.Buffer
-	session.Stderr = &stderr
+	defer releaseProvisionSlot()
 
 	log.Printf("Importing image with UUID: %s\n", uuid.String())
 
-	command := fmt.Sprintf("imgadm import %s", uuid.String())
-	err = session.Run(command)
+	outputBytes, _, err := c.run(ctx, nodeName, []string{"imgadm", "import", uuid.String()}, nil, true)
 	if err != nil {
-		return fmt.Errorf("remote command vmadm failed.  Error: %s (%s)", err, stderr.String())
+		return err
 	}
 
-	outputBytes := b.Bytes()
-
 	output := string(outputBytes)
 	log.Printf("Returned data: %s", output)
 
 	return nil
 }
 
-func (c *SmartOSClient) GetImage(nodeName string, name string, version string) (*Image, error) {
-	image, err := c.GetLocalImage(nodeName, name, version)
+func (c *SmartOSClient) GetImage(ctx context.Context, nodeName string, name string, version string) (*Image, error) {
+	image, err := c.GetLocalImage(ctx, nodeName, name, version)
 	if err != nil {
 		return nil, err
 	}
 
 	if image == nil {
-		image, err = c.FindRemoteImage(nodeName, name, version)
+		image, err = c.FindRemoteImage(ctx, nodeName, name, version)
 		if err != nil {
 			return nil, err
 		}
 
-		err = c.ImportRemoteImage(nodeName, *image.ID)
+		err = c.ImportRemoteImage(ctx, nodeName, *image.ID)
 		if err != nil {
 			return nil, err
 		}
@@ -418,3 +449,31 @@ func (c *SmartOSClient) GetImage(nodeName string, name string, version string) (
 
 	return image, nil
 }
+
+// redactMachineJSON returns the JSON of a machine for logging, with the values of its internal
+// metadata and its VNC password left out.
+func redactMachineJSON(data []byte) string {
+	var machine map[string]interface{}
+	if err := json.Unmarshal(data, &machine); err != nil {
+		return string(data)
+	}
+
+	for _, key := range []string{"internal_metadata", "set_internal_metadata"} {
+		if values, ok := machine[key].(map[string]interface{}); ok {
+			for k := range values {
+				values[k] = "(sensitive)"
+			}
+		}
+	}
+
+	if _, ok := machine["vnc_password"]; ok {
+		machine["vnc_password"] = "(sensitive)"
+	}
+
+	redacted, err := json.Marshal(machine)
+	if err != nil {
+		return string(data)
+	}
+
+	return string(redacted)
+}
@@ -0,0 +1,774 @@
+package smartos
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/terraform"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var testImage = fakeImage{
+	UUID:    "e75c9d82-3156-11ea-9220-c7a6bb9f41b6",
+	Name:    "base-64-lts",
+	Version: "19.4.0",
+	OS:      "smartos",
+}
+
+func testMachine(nodeName string) *Machine {
+	imageUUID := uuid.MustParse(testImage.UUID)
+
+	return &Machine{
+		NodeName:  nodeName,
+		Alias:     "test",
+		Brand:     "joyent",
+		ImageUUID: &imageUUID,
+		RAM:       newUint32(256),
+		CustomerMetadata: map[string]string{
+			"user-script": "echo hello",
+		},
+		NetworkInterfaces: []NetworkInterface{
+			{
+				Interface:   "net0",
+				IPAddresses: []string{"10.0.0.10/24"},
+				Tag:         "admin",
+			},
+		},
+	}
+}
+
+func TestClient_machineLifecycle(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+	f.AddAvailableImage(testImage)
+
+	client := testClient(t, f, nil)
+	defer client.Close()
+	ctx := context.Background()
+
+	id, err := client.CreateMachine(ctx, "node1", testMachine("node1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if f.CommandCount("imgadm import "+testImage.UUID) != 1 {
+		t.Errorf("expected the image to be imported before the machine was created")
+	}
+
+	machine, err := client.GetMachine(ctx, "node1", *id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if machine.Alias != "test" || machine.State != "running" {
+		t.Errorf("unexpected machine: alias %q, state %q", machine.Alias, machine.State)
+	}
+
+	if machine.PrimaryIP != "10.0.0.10" {
+		t.Errorf("primary IP = %q, want 10.0.0.10", machine.PrimaryIP)
+	}
+
+	update := Machine{ID: id, Alias: "renamed"}
+	update.setCustomerMetadata("foo", "bar")
+	update.removeCustomerMetadata("user-script")
+	if err := client.UpdateMachine(ctx, "node1", &update); err != nil {
+		t.Fatal(err)
+	}
+
+	machine, err = client.GetMachine(ctx, "node1", *id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if machine.Alias != "renamed" {
+		t.Errorf("alias = %q, want renamed", machine.Alias)
+	}
+
+	if !reflect.DeepEqual(machine.CustomerMetadata, map[string]string{"foo": "bar"}) {
+		t.Errorf("customer_metadata = %v, want foo=bar", machine.CustomerMetadata)
+	}
+
+	if err := client.DeleteMachine(ctx, "node1", *id); err != nil {
+		t.Fatal(err)
+	}
+
+	if f.Machine(id.String()) != nil {
+		t.Errorf("machine still exists after delete")
+	}
+}
+
+func TestClient_getMissingMachine(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+
+	client := testClient(t, f, nil)
+	defer client.Close()
+	ctx := context.Background()
+
+	_, err := client.GetMachine(ctx, "node1", uuid.New())
+
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+
+	if !strings.Contains(err.Error(), "No such zone configured") {
+		t.Errorf("error does not include the vmadm message: %s", err)
+	}
+
+	// A missing VM is a permanent failure.
+	if count := f.CommandCount("vmadm get"); count != 1 {
+		t.Errorf("vmadm get ran %d times, want 1", count)
+	}
+}
+
+func TestClient_findMachineByAlias(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+	id := f.AddMachine(map[string]interface{}{"brand": "joyent", "alias": "web-01.prod"})
+
+	client := testClient(t, f, nil)
+	defer client.Close()
+	ctx := context.Background()
+
+	found, err := client.FindMachineByAlias(ctx, "node1", "web-01.prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if found.String() != id {
+		t.Errorf("found %s, want %s", found, id)
+	}
+
+	// vmadm list would read these as a regular expression or a different filter.
+	for _, alias := range []string{"~web", "~.*", "web 01", "web,brand=kvm"} {
+		if _, err := client.FindMachineByAlias(ctx, "node1", alias); err == nil || !strings.Contains(err.Error(), "invalid alias") {
+			t.Errorf("alias %q: error = %v, want invalid alias", alias, err)
+		}
+	}
+
+	if count := f.CommandCount("vmadm list"); count != 1 {
+		t.Errorf("vmadm list ran %d times, want 1", count)
+	}
+}
+
+func TestClient_badJSON(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+	id := f.AddMachine(map[string]interface{}{"brand": "joyent", "alias": "test"})
+
+	client := testClient(t, f, nil)
+	defer client.Close()
+	ctx := context.Background()
+
+	f.Fail("vmadm get", fakeFailBadJSON, "", 1)
+
+	if _, err := client.GetMachine(ctx, "node1", uuid.MustParse(id)); err == nil {
+		t.Fatal("expected an error for malformed vmadm output")
+	}
+}
+
+func TestClient_retriesDroppedCommands(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+	id := f.AddMachine(map[string]interface{}{"brand": "joyent", "alias": "test"})
+
+	client := testClient(t, f, nil)
+	defer client.Close()
+	ctx := context.Background()
+
+	f.Fail("vmadm get", fakeFailDisconnect, "", 2)
+
+	machine, err := client.GetMachine(ctx, "node1", uuid.MustParse(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if machine.Alias != "test" {
+		t.Errorf("alias = %q, want test", machine.Alias)
+	}
+
+	if count := f.CommandCount("vmadm get"); count != 3 {
+		t.Errorf("vmadm get ran %d times, want 3", count)
+	}
+}
+
+func TestClient_retriesTransientErrors(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+	id := f.AddMachine(map[string]interface{}{"brand": "joyent", "alias": "test"})
+
+	client := testClient(t, f, nil)
+	defer client.Close()
+	ctx := context.Background()
+
+	f.Fail("vmadm update", fakeFailExit, "Failed to update VM: failed to acquire lock\n", 1)
+
+	if err := client.UpdateMachine(ctx, "node1", &Machine{ID: newUUID(id), Alias: "renamed"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if alias := f.Machine(id)["alias"]; alias != "renamed" {
+		t.Errorf("alias = %v, want renamed", alias)
+	}
+}
+
+func TestClient_doesNotRetryInterruptedCreate(t *testing.T) {
+	// The connection is lost while the command runs, or before the exec request is answered.
+	for _, kind := range []fakeFailureKind{fakeFailDisconnect, fakeFailDropExec} {
+		f := newFakeSmartOS(t)
+		defer f.Close()
+		f.AddInstalledImage(testImage)
+
+		client := testClient(t, f, nil)
+		defer client.Close()
+		ctx := context.Background()
+
+		f.Fail("vmadm create", kind, "", 1)
+
+		if _, err := client.CreateMachine(ctx, "node1", testMachine("node1")); err == nil {
+			t.Fatalf("failure %d: expected the interrupted create to fail", kind)
+		}
+
+		if count := f.CommandCount("vmadm create"); count != 1 {
+			t.Errorf("failure %d: vmadm create ran %d times, want 1", kind, count)
+		}
+	}
+}
+
+func TestClient_retriesRejectedCreate(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+	f.AddInstalledImage(testImage)
+
+	client := testClient(t, f, nil)
+	defer client.Close()
+	ctx := context.Background()
+
+	// The exec request is rejected, so the command never started.
+	f.Fail("vmadm create", fakeFailRejectExec, "", 1)
+
+	if _, err := client.CreateMachine(ctx, "node1", testMachine("node1")); err != nil {
+		t.Fatal(err)
+	}
+
+	if count := f.CommandCount("vmadm create"); count != 1 {
+		t.Errorf("vmadm create ran %d times, want 1", count)
+	}
+}
+
+func TestClient_retriesInterruptedFirewallRuleCreate(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+
+	client := testClient(t, f, nil)
+	defer client.Close()
+	ctx := context.Background()
+
+	// The rule is added but the connection is lost before fwadm exits.
+	f.Fail("fwadm add", fakeFailLoseExit, "", 1)
+
+	id, err := client.CreateFirewallRule(ctx, "node1", &FirewallRule{Rule: "FROM any TO all vms ALLOW tcp PORT 22", Enabled: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if f.FirewallRule(id.String()) == nil {
+		t.Errorf("firewall rule %s was not added", id)
+	}
+
+	if count := f.CommandCount("fwadm add"); count != 2 {
+		t.Errorf("fwadm add ran %d times, want 2", count)
+	}
+}
+
+func TestClient_reconnectsAfterDroppedConnection(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+	id := f.AddMachine(map[string]interface{}{"brand": "joyent", "alias": "test"})
+
+	client := testClient(t, f, nil)
+	defer client.Close()
+	ctx := context.Background()
+
+	if _, err := client.GetMachine(ctx, "node1", uuid.MustParse(id)); err != nil {
+		t.Fatal(err)
+	}
+
+	f.DropConnections()
+
+	if _, err := client.GetMachine(ctx, "node1", uuid.MustParse(id)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClient_sessionLimit(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+	id := f.AddMachine(map[string]interface{}{"brand": "joyent", "alias": "test"})
+
+	client := testClient(t, f, map[string]interface{}{"max_sessions": 2})
+	defer client.Close()
+	ctx := context.Background()
+
+	// Slow commands down so that sessions overlap.
+	f.SetCommandDelay(50 * time.Millisecond)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := client.GetMachine(ctx, "node1", uuid.MustParse(id)); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if max := f.MaxConcurrentSessions(); max > 2 {
+		t.Errorf("%d concurrent sessions, want at most 2", max)
+	}
+}
+
+func TestClient_hostKeyMismatch(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+
+	// A retry would wait for a minute.
+	client := testClient(t, f, map[string]interface{}{"retry_initial_backoff": 60})
+	defer client.Close()
+	ctx := context.Background()
+
+	client.hosts["node1"].HostKey = "SHA256:47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU"
+
+	start := time.Now()
+	_, err := client.GetMachine(ctx, "node1", uuid.New())
+
+	var mismatchError *HostKeyMismatchError
+	if !errors.As(err, &mismatchError) {
+		t.Fatalf("expected a host key mismatch, got %v", err)
+	}
+
+	if !strings.Contains(err.Error(), "host key mismatch for node node1") {
+		t.Errorf("error does not name the node: %s", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("GetMachine returned after %s, the mismatch was retried", elapsed)
+	}
+}
+
+func TestClient_passwordAuthentication(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+	id := f.AddMachine(map[string]interface{}{"brand": "joyent", "alias": "test"})
+
+	// Only the password is offered.
+	if socket, ok := os.LookupEnv("SSH_AUTH_SOCK"); ok {
+		defer os.Setenv("SSH_AUTH_SOCK", socket)
+		os.Unsetenv("SSH_AUTH_SOCK")
+	}
+
+	raw := f.ProviderRawConfig()
+	host := raw["host"].([]interface{})[0].(map[string]interface{})
+	delete(host, "private_key")
+	host["password"] = "secret"
+
+	provider := Provider()
+	if diags := provider.Configure(context.Background(), terraform.NewResourceConfigRaw(raw)); diags.HasError() {
+		t.Fatalf("failed to configure provider: %+v", diags)
+	}
+
+	client := provider.Meta().(*SmartOSClient)
+	defer client.Close()
+
+	if _, err := client.GetMachine(context.Background(), "node1", uuid.MustParse(id)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClient_authenticationRejected(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+
+	client := testClient(t, f, map[string]interface{}{"retry_initial_backoff": 60})
+	defer client.Close()
+	ctx := context.Background()
+
+	client.hosts["node1"].authMethods = []ssh.AuthMethod{ssh.Password("wrong")}
+
+	start := time.Now()
+	_, err := client.GetMachine(ctx, "node1", uuid.New())
+
+	var rejectedError *ConnectRejectedError
+	if !errors.As(err, &rejectedError) || rejectedError.NodeName != "node1" {
+		t.Fatalf("expected the connection to node1 to be rejected, got %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("GetMachine returned after %s, the rejected connection was retried", elapsed)
+	}
+}
+
+func TestClient_bastion(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+	id := f.AddMachine(map[string]interface{}{"brand": "joyent", "alias": "test"})
+
+	b := newFakeBastion(t, "jump")
+	defer b.Close()
+
+	target := fmt.Sprintf("127.0.0.1:%d", f.Port())
+
+	bastion := func(hostKey string) []interface{} {
+		return []interface{}{
+			map[string]interface{}{
+				"address":  "127.0.0.1",
+				"port":     b.Port(),
+				"password": "jump",
+				"host_key": hostKey,
+			},
+		}
+	}
+
+	t.Run("pinned host key", func(t *testing.T) {
+		client := testClient(t, f, map[string]interface{}{"bastion": bastion(b.HostKeyFingerprint())})
+		defer client.Close()
+
+		if _, err := client.GetMachine(context.Background(), "node1", uuid.MustParse(id)); err != nil {
+			t.Fatal(err)
+		}
+
+		if targets := b.Targets(); !reflect.DeepEqual(targets, []string{target}) {
+			t.Errorf("bastion forwarded to %v, want %s", targets, target)
+		}
+	})
+
+	t.Run("host key mismatch", func(t *testing.T) {
+		// The node's host key is not accepted for the bastion.
+		client := testClient(t, f, map[string]interface{}{"bastion": bastion(f.HostKeyFingerprint())})
+		defer client.Close()
+
+		_, err := client.GetMachine(context.Background(), "node1", uuid.MustParse(id))
+
+		var mismatchError *HostKeyMismatchError
+		if !errors.As(err, &mismatchError) || mismatchError.NodeName != "bastion 127.0.0.1" {
+			t.Fatalf("expected a host key mismatch for the bastion, got %v", err)
+		}
+	})
+
+	t.Run("trust on first use", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "bastion")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		managedKnownHostsFile := filepath.Join(dir, "smartos_known_hosts")
+
+		client := testClient(t, f, map[string]interface{}{
+			"bastion":                  bastion(""),
+			"known_hosts_file":         filepath.Join(dir, "known_hosts"),
+			"managed_known_hosts_file": managedKnownHostsFile,
+			"trust_on_first_use":       true,
+		})
+		defer client.Close()
+
+		if _, err := client.GetMachine(context.Background(), "node1", uuid.MustParse(id)); err != nil {
+			t.Fatal(err)
+		}
+
+		// Only the bastion is recorded, under its own address; the node's key is pinned.
+		managed, err := ioutil.ReadFile(managedKnownHostsFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		address := fmt.Sprintf("127.0.0.1:%d", b.Port())
+		want := knownhosts.Line([]string{knownhosts.Normalize(address)}, b.hostKey.PublicKey()) + "\n"
+		if string(managed) != want {
+			t.Errorf("managed known_hosts file = %q, want %q", managed, want)
+		}
+	})
+}
+
+func TestClient_images(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+	f.AddAvailableImage(testImage)
+
+	client := testClient(t, f, nil)
+	defer client.Close()
+	ctx := context.Background()
+
+	image, err := client.GetLocalImage(ctx, "node1", testImage.Name, testImage.Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if image != nil {
+		t.Fatalf("image should not be installed yet, got %v", image.ID)
+	}
+
+	image, err = client.GetImage(ctx, "node1", testImage.Name, testImage.Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if image.ID.String() != testImage.UUID {
+		t.Errorf("image UUID = %s, want %s", image.ID, testImage.UUID)
+	}
+
+	image, err = client.GetLocalImage(ctx, "node1", testImage.Name, testImage.Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if image == nil {
+		t.Fatal("image should be installed after GetImage")
+	}
+}
+
+func TestClient_argumentsAreQuoted(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+
+	client := testClient(t, f, nil)
+	defer client.Close()
+	ctx := context.Background()
+
+	name := "base'; rm -rf / #"
+	if _, err := client.GetLocalImage(ctx, "node1", name, "$(reboot)"); err != nil {
+		t.Fatal(err)
+	}
+
+	commands := f.Commands()
+	want := []string{"imgadm", "list", "-j", "name=" + name, "version=$(reboot)"}
+	if len(commands) != 1 || !reflect.DeepEqual(commands[0], want) {
+		t.Errorf("commands = %q, want %q", commands, [][]string{want})
+	}
+}
+
+func TestClient_unknownNode(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+
+	client := testClient(t, f, nil)
+	defer client.Close()
+	ctx := context.Background()
+
+	if _, err := client.GetMachine(ctx, "node2", uuid.New()); err == nil {
+		t.Fatal("expected an error for an unknown node")
+	}
+}
+
+func newUUID(s string) *uuid.UUID {
+	id := uuid.MustParse(s)
+	return &id
+}
+
+func TestClient_cancelKillsCommand(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+	id := f.AddMachine(map[string]interface{}{"brand": "joyent", "alias": "test"})
+
+	client := testClient(t, f, nil)
+	defer client.Close()
+
+	f.FailSlowly("vmadm get", time.Minute, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := client.GetMachine(ctx, "node1", uuid.MustParse(id))
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("GetMachine returned after %s, long after the context was done", elapsed)
+	}
+
+	if signals := f.Signals(); !reflect.DeepEqual(signals, []string{"KILL"}) {
+		t.Errorf("signals = %v, want [KILL]", signals)
+	}
+
+	// A command that was cancelled is not retried.
+	if count := f.CommandCount("vmadm get"); count != 1 {
+		t.Errorf("vmadm get ran %d times, want 1", count)
+	}
+}
+
+func TestClient_cancelWhileWaitingForSession(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+	id := f.AddMachine(map[string]interface{}{"brand": "joyent", "alias": "test"})
+
+	client := testClient(t, f, map[string]interface{}{"max_sessions": 1})
+	defer client.Close()
+
+	f.FailSlowly("vmadm get", time.Minute, 1)
+
+	// Hold the only session with a command that hangs.
+	holder, cancelHolder := context.WithCancel(context.Background())
+	held := make(chan struct{})
+	go func() {
+		defer close(held)
+		client.GetMachine(holder, "node1", uuid.MustParse(id))
+	}()
+	defer func() {
+		cancelHolder()
+		<-held
+	}()
+
+	for f.CommandCount("vmadm get") == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	if _, err := client.GetMachine(ctx, "node1", uuid.MustParse(id)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	if count := f.CommandCount("vmadm get"); count != 1 {
+		t.Errorf("vmadm get ran %d times, want 1", count)
+	}
+}
+
+func TestClient_cancelWhileOpeningSession(t *testing.T) {
+	f := newFakeSmartOS(t)
+	defer f.Close()
+	f.AddInstalledImage(testImage)
+
+	client := testClient(t, f, nil)
+	defer client.Close()
+
+	// A create runs on the node's connection while another caller gives up opening a session.
+	f.SetCommandDelay(time.Second)
+	created := make(chan error, 1)
+	go func() {
+		_, err := client.CreateMachine(context.Background(), "node1", testMachine("node1"))
+		created <- err
+	}()
+
+	for f.CommandCount("vmadm create") == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	f.HoldSessions(2*time.Second, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	if _, err := client.GetMachine(ctx, "node1", uuid.New()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+
+	if err := <-created; err != nil {
+		t.Errorf("create failed when another caller gave up: %v", err)
+	}
+
+	if count := f.CommandCount("vmadm create"); count != 1 {
+		t.Errorf("vmadm create ran %d times, want 1", count)
+	}
+}
+
+func TestClient_cancelWhileConnecting(t *testing.T) {
+	// A node that accepts connections but never answers the SSH handshake.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		var conns []net.Conn
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				break
+			}
+			conns = append(conns, conn)
+		}
+
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	raw := map[string]interface{}{
+		"hosts": map[string]interface{}{
+			"node1": listener.Addr().String(),
+		},
+		"password":           "secret",
+		"trust_on_first_use": true,
+		"max_retries":        0,
+	}
+
+	provider := Provider()
+	if diags := provider.Configure(context.Background(), terraform.NewResourceConfigRaw(raw)); diags.HasError() {
+		t.Fatalf("failed to configure provider: %+v", diags)
+	}
+
+	client := provider.Meta().(*SmartOSClient)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	// The second call waits for the first one's connection and gives up along with it.
+	start := time.Now()
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := client.GetMachine(ctx, "node1", uuid.New())
+			errs <- err
+		}()
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := <-errs; !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected context.DeadlineExceeded, got %v", err)
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("GetMachine returned after %s, long after the context was done", elapsed)
+	}
+}
+
+func TestRedactMachineJSON(t *testing.T) {
+	redacted := redactMachineJSON([]byte(`{"alias":"builder","internal_metadata":{"operator:token":"s3cret"},"set_internal_metadata":{"operator:url":"https://operator.example.com"},"vnc_password":"hunter2"}`))
+
+	for _, secret := range []string{"s3cret", "operator.example.com", "hunter2"} {
+		if strings.Contains(redacted, secret) {
+			t.Errorf("%q was not redacted: %s", secret, redacted)
+		}
+	}
+
+	if !strings.Contains(redacted, `"operator:token":"(sensitive)"`) || !strings.Contains(redacted, `"alias":"builder"`) {
+		t.Errorf("unexpected redacted JSON: %s", redacted)
+	}
+}
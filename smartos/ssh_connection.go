@@ -0,0 +1,156 @@
+package smartos
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const sshConnectTimeout = 30 * time.Second
+
+// sshConnection is an SSH connection to a global zone along with the connections to the
+// bastions it is tunnelled through.
+type sshConnection struct {
+	*ssh.Client
+	bastions []*ssh.Client
+}
+
+// dialHost connects to a host, hopping through its bastions in order the same way OpenSSH's
+// ProxyJump does.  Each hop has sshConnectTimeout to connect and finish its handshake, and
+// connecting is given up when the context is done.
+func dialHost(ctx context.Context, host *Host, hostKeyVerifier *HostKeyVerifier) (*sshConnection, error) {
+	connection := &sshConnection{}
+
+	hops := append(append([]*Host{}, host.Bastions...), host)
+	for _, hop := range hops {
+		client, err := connection.dialHop(ctx, hop, hops, hostKeyVerifier)
+		if err != nil {
+			connection.Close()
+			return nil, err
+		}
+
+		if hop == host {
+			connection.Client = client
+		} else {
+			connection.bastions = append(connection.bastions, client)
+		}
+	}
+
+	return connection, nil
+}
+
+// dialHop connects to the next hop, directly or through the last bastion connected so far.
+func (c *sshConnection) dialHop(ctx context.Context, hop *Host, hops []*Host, hostKeyVerifier *HostKeyVerifier) (*ssh.Client, error) {
+	ctx, cancel := context.WithTimeout(ctx, sshConnectTimeout)
+	defer cancel()
+
+	// The handshake flattens the error of the host key callback into its message, so it is
+	// kept to be returned as is.
+	var hostKeyErr error
+	hostKeyCallback := hostKeyVerifier.HostKeyCallback(hop.Name, hop.HostKey)
+
+	config := &ssh.ClientConfig{
+		User: hop.User,
+		Auth: hop.authMethods,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			hostKeyErr = hostKeyCallback(hostname, remote, key)
+			return hostKeyErr
+		},
+	}
+
+	var conn net.Conn
+	var err error
+
+	if len(c.bastions) == 0 {
+		log.Printf("SSH: Connecting to %s at %s as %s", hop.Name, hop.Endpoint(), hop.User)
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", hop.Endpoint())
+	} else {
+		// Dialing through a bastion cannot be cancelled, so the bastion connections are
+		// closed to give up on it.
+		bastion := c.bastions[len(c.bastions)-1]
+		log.Printf("SSH: Connecting to %s at %s as %s through %s", hop.Name, hop.Endpoint(), hop.User, hops[len(c.bastions)-1].Name)
+		err = abortable(ctx, func() { c.Close() }, func() error {
+			var err error
+			conn, err = bastion.Dial("tcp", hop.Endpoint())
+			return err
+		})
+	}
+
+	if err != nil {
+		return nil, connectError(ctx, hop, err)
+	}
+
+	// The handshake has no deadline of its own, so the connection is closed to give up on it.
+	var clientConn ssh.Conn
+	var channels <-chan ssh.NewChannel
+	var requests <-chan *ssh.Request
+
+	err = abortable(ctx, func() { conn.Close(); c.Close() }, func() error {
+		var err error
+		clientConn, channels, requests, err = ssh.NewClientConn(conn, hop.Endpoint(), config)
+		return err
+	})
+
+	if err != nil {
+		conn.Close()
+
+		switch {
+		case hostKeyErr != nil:
+			return nil, &ConnectRejectedError{NodeName: hop.Name, Err: hostKeyErr}
+		case isAuthenticationRejected(err):
+			return nil, &ConnectRejectedError{NodeName: hop.Name, Err: err}
+		}
+
+		return nil, connectError(ctx, hop, err)
+	}
+
+	return ssh.NewClient(clientConn, channels, requests), nil
+}
+
+// connectError names the hop when connecting to it was given up, since the context's error
+// does not say what it was waiting for.
+func connectError(ctx context.Context, hop *Host, err error) error {
+	if ctx.Err() == nil {
+		return err
+	}
+
+	return fmt.Errorf("connecting to %s at %s: %w", hop.Name, hop.Endpoint(), err)
+}
+
+// abortable runs f and returns its error.  When the context is done first, abort is called,
+// which has to make f return, and the context's error is returned instead.
+func abortable(ctx context.Context, abort func(), f func() error) error {
+	result := make(chan error, 1)
+	go func() {
+		result <- f()
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		abort()
+		<-result
+		return ctx.Err()
+	}
+}
+
+// Close closes the connection to the global zone followed by the bastion connections,
+// innermost first.
+func (c *sshConnection) Close() error {
+	var err error
+
+	if c.Client != nil {
+		err = c.Client.Close()
+	}
+
+	for i := len(c.bastions) - 1; i >= 0; i-- {
+		c.bastions[i].Close()
+	}
+
+	return err
+}